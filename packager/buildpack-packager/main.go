@@ -4,11 +4,13 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/cloudfoundry/libbuildpack"
 	"github.com/cloudfoundry/libbuildpack/packager"
@@ -37,18 +39,63 @@ func (s *summaryCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{
 	return subcommands.ExitSuccess
 }
 
+type lintCmd struct {
+	checkURIs bool
+}
+
+func (*lintCmd) Name() string     { return "lint" }
+func (*lintCmd) Synopsis() string { return "Check the manifest.yml of this buildpack" }
+func (*lintCmd) Usage() string {
+	return `lint [-check-uris]:
+  When run in a directory that is structured as a buildpack, prints the problems with its manifest.yml.
+  Exits with an error when there is any problem which would stop it being packaged.
+`
+}
+func (l *lintCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&l.checkURIs, "check-uris", false, "check that every dependency uri is reachable")
+}
+func (l *lintCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	warnings, errors, err := packager.LintManifestWithOptions(ctx, ".", packager.LintOptions{CheckURIs: l.checkURIs})
+	if err != nil {
+		log.Printf("error linting manifest: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	logger := libbuildpack.NewLogger(os.Stdout)
+	for _, warning := range warnings {
+		logger.Warning("%s", warning)
+	}
+	for _, e := range errors {
+		logger.Error("%s", e)
+	}
+	if len(errors) > 0 {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
 type buildCmd struct {
-	cached   bool
-	anyStack bool
-	version  string
-	cacheDir string
-	stack    string
+	cached         bool
+	anyStack       bool
+	version        string
+	cacheDir       string
+	stack          string
+	signingKey     string
+	strictVersion  bool
+	allowUnchecked bool
+	skipFileSums   bool
+	nameTemplate   string
+	keepVersion    bool
+	timeout        time.Duration
+	preTimeout     time.Duration
+	keepGoing      bool
+	verbose        bool
 }
 
 func (*buildCmd) Name() string     { return "build" }
 func (*buildCmd) Synopsis() string { return "Create a buildpack zipfile from the current directory" }
 func (*buildCmd) Usage() string {
-	return `build -stack <stack>|-any-stack [-cached] [-version <version>] [-cachedir <path to cachedir>]:
+	return `build -stack <stack>|-any-stack [-cached] [-version <version>] [-cachedir <path to cachedir>] [-signing-key <path to gpg private key>] [-strict-version] [-allow-unchecked] [-skip-file-checksums] [-filename-template <template>] [-keep-version-file] [-timeout <duration>] [-pre-package-timeout <duration>] [-keep-going] [-verbose]:
   When run in a directory that is structured as a buildpack, creates a zip file.
 
 `
@@ -60,8 +107,18 @@ func (b *buildCmd) SetFlags(f *flag.FlagSet) {
 
 	f.StringVar(&b.stack, "stack", "", "stack to package buildpack for")
 	f.BoolVar(&b.anyStack, "any-stack", false, "package buildpack for any stack")
+	f.StringVar(&b.signingKey, "signing-key", "", "armored gpg private key used to sign the zipfile")
+	f.BoolVar(&b.strictVersion, "strict-version", false, "require the version to be a semantic version")
+	f.BoolVar(&b.allowUnchecked, "allow-unchecked", false, "package dependencies without a checksum, unverified")
+	f.BoolVar(&b.skipFileSums, "skip-file-checksums", false, "do not verify the checksums of file:// dependencies")
+	f.BoolVar(&b.keepGoing, "keep-going", false, "download every dependency and report all failures, rather than stopping at the first")
+	f.BoolVar(&b.verbose, "verbose", false, "log cache hits and misses, skipped paths, uri rewrites and compression decisions")
+	f.DurationVar(&b.timeout, "timeout", 0, "give up packaging after this long, such as 10m")
+	f.DurationVar(&b.preTimeout, "pre-package-timeout", 0, "kill the pre_package command after this long (default 5m, negative for no limit)")
+	f.BoolVar(&b.keepVersion, "keep-version-file", false, "package the existing VERSION file rather than writing -version into it")
+	f.StringVar(&b.nameTemplate, "filename-template", "", "name the zipfile with a template using {language}, {version}, {stack} and {cached}")
 }
-func (b *buildCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+func (b *buildCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 	if b.stack == "" && !b.anyStack {
 		log.Printf("error: must either specify a stack or pass -any-stack")
 		return subcommands.ExitFailure
@@ -70,16 +127,29 @@ func (b *buildCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{})
 		log.Printf("error: cannot specify a stack AND pass -any-stack")
 		return subcommands.ExitFailure
 	}
-	if b.version == "" {
-		v, err := ioutil.ReadFile("VERSION")
-		if err != nil {
-			log.Printf("error: Could not read VERSION file: %v", err)
-			return subcommands.ExitFailure
-		}
-		b.version = strings.TrimSpace(string(v))
+	versionCheck := packager.VersionCheckNone
+	if b.strictVersion {
+		versionCheck = packager.VersionCheckStrict
 	}
 
-	zipFile, err := packager.Package(".", b.cacheDir, b.version, b.stack, b.cached)
+	result, err := packager.PackageWithContext(ctx, packager.PackageOptions{
+		BuildpackDir: ".",
+		CacheDir:     b.cacheDir,
+		Version:      b.version,
+		Stack:        b.stack,
+		Cached:       b.cached,
+		SigningKey:   b.signingKey,
+		VersionCheck: versionCheck,
+
+		AllowUnchecked:    b.allowUnchecked,
+		SkipFileChecksums: b.skipFileSums,
+		FilenameTemplate:  b.nameTemplate,
+		KeepVersionFile:   b.keepVersion,
+		Timeout:           b.timeout,
+		PrePackageTimeout: b.preTimeout,
+		KeepGoing:         b.keepGoing,
+		Verbose:           b.verbose,
+	})
 	if err != nil {
 		log.Printf("error while creating zipfile: %v", err)
 		return subcommands.ExitFailure
@@ -90,13 +160,10 @@ func (b *buildCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{})
 		buildpackType = "cached"
 	}
 
-	stat, err := os.Stat(zipFile)
-	if err != nil {
-		log.Printf("error while stating zipfile: %v", err)
-		return subcommands.ExitFailure
+	fmt.Printf("%s buildpack created and saved as %s with a size of %dMB\n", buildpackType, result.ZipFile, result.Size/1024/1024)
+	if result.SignatureFile != "" {
+		fmt.Printf("signature saved as %s\n", result.SignatureFile)
 	}
-
-	fmt.Printf("%s buildpack created and saved as %s with a size of %dMB\n", buildpackType, zipFile, stat.Size()/1024/1024)
 	return subcommands.ExitSuccess
 }
 
@@ -199,11 +266,16 @@ func main() {
 	subcommands.Register(subcommands.FlagsCommand(), "")
 	subcommands.Register(subcommands.CommandsCommand(), "")
 	subcommands.Register(&summaryCmd{}, "Custom")
+	subcommands.Register(&lintCmd{}, "Custom")
 	subcommands.Register(&buildCmd{}, "Custom")
 	subcommands.Register(&initCmd{}, "Custom")
 	subcommands.Register(&upgradeCmd{}, "Custom")
 
 	flag.Parse()
-	ctx := context.Background()
-	os.Exit(int(subcommands.Execute(ctx)))
+	// Interrupting the packager stops a build, killing its pre_package
+	// command, rather than leaving a partial zip behind.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	status := subcommands.Execute(ctx)
+	stop()
+	os.Exit(int(status))
 }
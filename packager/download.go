@@ -0,0 +1,1242 @@
+package packager
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+const DefaultMaxConcurrentDownloads = 4
+
+// DefaultUserAgent identifies the packager, and the libbuildpack version it
+// was built from when known, to the servers dependencies are downloaded from.
+var DefaultUserAgent = defaultUserAgent()
+
+func defaultUserAgent() string {
+	const module = "github.com/cloudfoundry/libbuildpack"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "libbuildpack-packager"
+	}
+	modules := append([]*debug.Module{&info.Main}, info.Deps...)
+	for _, m := range modules {
+		if m.Path == module && m.Version != "" && m.Version != "(devel)" {
+			return "libbuildpack-packager/" + m.Version
+		}
+	}
+	return "libbuildpack-packager"
+}
+
+// downloader fetches dependencies into a cache directory.
+type downloader struct {
+	cacheDir string
+	logger   *libbuildpack.Logger
+
+	// max caps the number of downloads in flight.
+	max int
+
+	// timeout bounds each dependency's download unless the dependency sets
+	// its own download_timeout. Zero means no limit.
+	timeout time.Duration
+
+	userAgent string
+
+	// netrc supplies basic auth credentials by host.
+	netrc netrcMachines
+
+	// maxBytesPerSecond limits the rate each download is read at. Zero
+	// means no limit.
+	maxBytesPerSecond int64
+
+	// maxSize fails downloads larger than it. Zero means no limit.
+	maxSize int64
+
+	// client makes the requests. Nil means http.DefaultClient.
+	client *http.Client
+
+	// transport is the transport of client when the downloader made the
+	// client itself, and so closes its idle connections when done.
+	transport *http.Transport
+
+	// allowUnchecked skips verifying dependencies that declare no
+	// checksum, rather than failing them.
+	allowUnchecked bool
+
+	// skipFileChecksums skips verifying file:// dependencies, which are
+	// then copied afresh on every build.
+	skipFileChecksums bool
+
+	rewrites []uriRewrite
+
+	// bpDir is the buildpack directory relative file:// URIs are resolved
+	// against. Empty means the current directory.
+	bpDir string
+
+	// progress, when set, is told how the downloads are getting on.
+	progress *progressTracker
+
+	// events, when set, is sent a download event as each dependency is
+	// obtained.
+	events *eventEmitter
+
+	// keepGoing downloads every dependency even after some have failed,
+	// reporting all of the failures together.
+	keepGoing bool
+
+	// verbose logs how each dependency was obtained.
+	verbose bool
+
+	// pool, when set, is a directory dependencies are taken from instead
+	// of being downloaded. poolNames maps a name@version to its file there.
+	pool      string
+	poolNames map[string]string
+}
+
+type uriRewrite struct {
+	match       *regexp.Regexp
+	replacement string
+}
+
+// debug logs a diagnostic when packaging is verbose.
+func (d *downloader) debug(format string, args ...interface{}) {
+	if d.verbose {
+		d.logger.Info(format, args...)
+	}
+}
+
+func (d *downloader) httpClient() *http.Client {
+	if d.client != nil {
+		return d.client
+	}
+	return http.DefaultClient
+}
+
+// newTransport copies http.DefaultTransport, which keeps connections alive
+// and speaks HTTP/2, keeping up to maxIdle idle connections per host for
+// idleTimeout, or the default 90 seconds when that is zero.
+func newTransport(maxIdle int, idleTimeout time.Duration) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxIdle
+	if idleTimeout > 0 {
+		transport.IdleConnTimeout = idleTimeout
+	}
+	return transport
+}
+
+// close releases the idle connections of a client the downloader made.
+func (d *downloader) close() {
+	if d.transport != nil {
+		d.transport.CloseIdleConnections()
+	}
+}
+
+func newDownloader(options PackageOptions, cacheDir string, logger *libbuildpack.Logger) (*downloader, error) {
+	d := &downloader{
+		cacheDir:  cacheDir,
+		logger:    logger,
+		max:       options.MaxConcurrentDownloads,
+		timeout:   options.DependencyTimeout,
+		userAgent: options.UserAgent,
+
+		maxBytesPerSecond: options.MaxBytesPerSecond,
+		maxSize:           options.MaxDependencySize,
+		client:            options.HTTPClient,
+		allowUnchecked:    options.AllowUnchecked,
+		skipFileChecksums: options.SkipFileChecksums,
+		bpDir:             options.BuildpackDir,
+		keepGoing:         options.KeepGoing,
+		verbose:           options.Verbose,
+		pool:              options.DependencyPool,
+		poolNames:         options.DependencyPoolNames,
+	}
+	if d.max == 0 {
+		d.max = DefaultMaxConcurrentDownloads
+	}
+	// One client for every download, so that connections to a mirror
+	// serving many dependencies are reused rather than set up each time.
+	if d.client == nil {
+		maxIdle := options.MaxIdleConnsPerHost
+		if maxIdle == 0 {
+			maxIdle = d.max
+		}
+		d.transport = newTransport(maxIdle, options.IdleConnTimeout)
+		d.client = &http.Client{Transport: d.transport}
+	}
+	if d.userAgent == "" {
+		d.userAgent = DefaultUserAgent
+	}
+	for _, rewrite := range options.URIRewrites {
+		match, err := regexp.Compile(rewrite.Match)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid URI rewrite %q: %v", rewrite.Match, err)
+		}
+		d.rewrites = append(d.rewrites, uriRewrite{match, rewrite.Replacement})
+	}
+	if options.OnProgress != nil {
+		d.progress = &progressTracker{callback: options.OnProgress, total: -1}
+	}
+	if options.UseNetrc {
+		var err error
+		if d.netrc, err = readNetrc(netrcPath()); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// dependencyFileName is the path of a dependency inside a packaged
+// buildpack.
+func dependencyFileName(dependency Dependency) string {
+	return filepath.Join("dependencies", fmt.Sprintf("%x", md5.Sum([]byte(dependency.URI))), filepath.Base(dependency.URI))
+}
+
+// CachePath is where a dependency is downloaded to within cacheDir: a
+// directory named for the sha256 of its URI holding a file named for the last
+// element of the URI. Caches written by older versions of the packager, keyed
+// on the md5 of the URI, are still read when present.
+func CachePath(dependency Dependency, cacheDir string) string {
+	return filepath.Join(cacheDir, "dependencies", fmt.Sprintf("%x", sha256.Sum256([]byte(dependency.URI))), filepath.Base(dependency.URI))
+}
+
+// legacyCachePath is where older versions of the packager cached a
+// dependency, keyed on the md5 of its URI.
+func legacyCachePath(dependency Dependency, cacheDir string) string {
+	return filepath.Join(cacheDir, dependencyFileName(dependency))
+}
+
+// blobPath is the content-addressed location of a dependency with the given
+// sha256 within cacheDir. Cache entries for different URIs with the same
+// content are linked to the same blob.
+func blobPath(sha256 string, cacheDir string) string {
+	return filepath.Join(cacheDir, "sha256", sha256)
+}
+
+// linkFile hard links src to dest, falling back to a copy when linking is
+// not possible.
+func linkFile(src, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(src, dest); err == nil || os.IsExist(err) {
+		return nil
+	}
+	return libbuildpack.CopyFile(src, dest)
+}
+
+// DownloadDependency downloads dependency into cacheDir, or reuses the
+// copy already cached there, and verifies its sha256. It is how Package
+// fetches the dependencies of a cached buildpack.
+func DownloadDependency(ctx context.Context, dependency Dependency, cacheDir string) (File, error) {
+	return defaultPackager().DownloadDependency(ctx, dependency, cacheDir)
+}
+
+// DownloadDependency is like the package-level DownloadDependency but logs
+// to p.Stdout and uses p.CacheDir when cacheDir is empty.
+func (p Packager) DownloadDependency(ctx context.Context, dependency Dependency, cacheDir string) (File, error) {
+	d, err := newDownloader(PackageOptions{}, p.cacheDir(cacheDir), libbuildpack.NewLogger(p.Stdout))
+	if err != nil {
+		return File{}, err
+	}
+	defer d.close()
+	file, _, err := d.downloadDependency(ctx, dependency)
+	return file, err
+}
+
+// downloadDependency fetches dependency into the cache, or finds it there,
+// and verifies it, emitting a download event once it has.
+func (d *downloader) downloadDependency(ctx context.Context, dependency Dependency) (File, DownloadStats, error) {
+	file, stats, err := d.obtainDependency(ctx, dependency)
+	if err != nil {
+		return File{}, DownloadStats{}, err
+	}
+	d.events.emit(Event{Event: "download", Dep: dependency.Name, Bytes: stats.Bytes})
+	return file, stats, nil
+}
+
+func (d *downloader) obtainDependency(ctx context.Context, dependency Dependency) (File, DownloadStats, error) {
+	if d.pool != "" {
+		return d.poolDependency(dependency)
+	}
+	start := time.Now()
+	stats := DownloadStats{CacheHit: true}
+	file := dependencyFileName(dependency)
+	// The cache and the zip are keyed by the manifest's uri, whichever
+	// uri the dependency is fetched from.
+	uri := d.rewriteURI(dependency.URI)
+	if uri != dependency.URI {
+		d.debug("%s %s: %s rewritten to %s", dependency.Name, dependency.Version, dependency.URI, uri)
+	}
+	if err := os.MkdirAll(d.cacheDir, 0755); err != nil {
+		return File{}, DownloadStats{}, fmt.Errorf("Failed to create cache directory %s: %v", d.cacheDir, err)
+	}
+
+	path := CachePath(dependency, d.cacheDir)
+	if _, err := os.Stat(path); err != nil {
+		if _, err := os.Stat(legacyCachePath(dependency, d.cacheDir)); err == nil {
+			path = legacyCachePath(dependency, d.cacheDir)
+		}
+	}
+
+	// An unverified file may not match its sha256, so it is neither shared
+	// through nor taken from the blob store, and never reused.
+	unverified := d.skipFileChecksums && isFileURI(uri)
+
+	blob := ""
+	if dependency.SHA256 != "" && !unverified {
+		blob = blobPath(dependency.SHA256, d.cacheDir)
+	}
+	if _, err := os.Stat(path); err != nil && blob != "" {
+		if _, err := os.Stat(blob); err == nil {
+			d.logger.Info("Reusing cached content for %s %s", dependency.Name, dependency.Version)
+			if err := linkFile(blob, path); err != nil {
+				return File{}, DownloadStats{}, err
+			}
+		}
+	}
+
+	before, statErr := os.Stat(path)
+	recorded, intact := "", true
+	if statErr == nil && !unverified {
+		recorded, intact = checkSidecar(path)
+	}
+	if !intact {
+		d.logger.Warning("Cached %s %s at %s does not match its recorded sha256, downloading it again", dependency.Name, dependency.Version, path)
+		os.Remove(path)
+		statErr = os.ErrNotExist
+	}
+	// A cached file which still has the recorded sha256, when that is the
+	// only checksum the manifest declares and matches it, was just hashed
+	// and need not be hashed again.
+	verified := intact && recorded != "" && recorded == dependency.SHA256 && dependency.SHA1 == "" && dependency.SHA512 == ""
+	if statErr != nil || dependency.Revalidate || unverified {
+		if err := d.fetchDependency(ctx, dependency, uri, path, statErr == nil); err != nil {
+			return File{}, DownloadStats{}, err
+		}
+
+		// A revalidated file that was not modified is left in place.
+		after, err := os.Stat(path)
+		stats.CacheHit = statErr == nil && err == nil && os.SameFile(before, after) && !unverified
+		verified = verified && stats.CacheHit
+	}
+
+	if unverified {
+		d.logger.Warning("Checksum verification of %s %s from %s was skipped", dependency.Name, dependency.Version, uri)
+	} else if d.allowUnchecked && !dependency.hasChecksum() {
+		d.logger.Warning("%s %s has no checksum and was not verified", dependency.Name, dependency.Version)
+	} else if verified {
+		d.debug("%s %s: cached copy matches its recorded sha256", dependency.Name, dependency.Version)
+	} else if err := checkChecksums(path, dependency); err != nil {
+		if !stats.CacheHit {
+			return File{}, DownloadStats{}, checksumError{fmt.Errorf("%s %s from %s (cached at %s): %w", dependency.Name, dependency.Version, uri, path, err)}
+		}
+
+		// The cached copy may have been corrupted on disk, so it is
+		// downloaded once more before the mismatch is reported.
+		d.logger.Warning("Cached %s %s at %s does not match its checksum, downloading it again", dependency.Name, dependency.Version, path)
+		if blob != "" {
+			if blobInfo, err := os.Stat(blob); err == nil {
+				if info, err := os.Stat(path); err == nil && os.SameFile(blobInfo, info) {
+					os.Remove(blob)
+				}
+			}
+		}
+		os.Remove(path)
+		os.Remove(validatorsPath(path))
+		if err := d.fetchDependency(ctx, dependency, uri, path, false); err != nil {
+			return File{}, DownloadStats{}, err
+		}
+		stats.CacheHit = false
+		if err := checkChecksums(path, dependency); err != nil {
+			return File{}, DownloadStats{}, checksumError{fmt.Errorf("%s %s from %s (cached at %s): %w", dependency.Name, dependency.Version, uri, path, err)}
+		}
+	}
+
+	if blob != "" {
+		if _, err := os.Stat(blob); err != nil {
+			if err := linkFile(path, blob); err != nil {
+				return File{}, DownloadStats{}, err
+			}
+		}
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		stats.Bytes = info.Size()
+	}
+	stats.Duration = time.Since(start)
+	if stats.CacheHit {
+		d.debug("%s %s: cache hit at %s", dependency.Name, dependency.Version, path)
+	} else {
+		d.debug("%s %s: cache miss, fetched %s to %s", dependency.Name, dependency.Version, uri, path)
+	}
+	return File{file, path}, stats, nil
+}
+
+// poolPath is where dependency is found in the dependency pool: the file
+// poolNames gives for its name@version or else the last element of its uri.
+func (d *downloader) poolPath(dependency Dependency) string {
+	name, ok := d.poolNames[dependency.Name+"@"+dependency.Version]
+	if !ok {
+		name = filepath.Base(dependency.URI)
+	}
+	return filepath.Join(d.pool, name)
+}
+
+// poolDependency takes dependency from the dependency pool, verifying it.
+// Nothing is downloaded or cached.
+func (d *downloader) poolDependency(dependency Dependency) (File, DownloadStats, error) {
+	start := time.Now()
+	path := d.poolPath(dependency)
+	info, err := os.Stat(path)
+	if err != nil {
+		return File{}, DownloadStats{}, fmt.Errorf("%s %s not found in dependency pool %s: %v", dependency.Name, dependency.Version, d.pool, err)
+	}
+
+	if d.allowUnchecked && !dependency.hasChecksum() {
+		d.logger.Warning("%s %s has no checksum and was not verified", dependency.Name, dependency.Version)
+	} else if err := checkChecksums(path, dependency); err != nil {
+		return File{}, DownloadStats{}, checksumError{fmt.Errorf("%s %s from dependency pool (%s): %w", dependency.Name, dependency.Version, path, err)}
+	}
+	d.debug("%s %s: taken from dependency pool at %s", dependency.Name, dependency.Version, path)
+	return File{dependencyFileName(dependency), path}, DownloadStats{CacheHit: true, Bytes: info.Size(), Duration: time.Since(start)}, nil
+}
+
+// checkPool reports every one of deps missing from the dependency pool at
+// once, before any is verified.
+func (d *downloader) checkPool(deps []Dependency) error {
+	var missing []string
+	seen := map[string]bool{}
+	for _, dep := range deps {
+		path := d.poolPath(dep)
+		if _, err := os.Stat(path); err != nil && !seen[path] {
+			seen[path] = true
+			missing = append(missing, fmt.Sprintf("%s %s (%s)", dep.Name, dep.Version, filepath.Base(path)))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Dependencies not found in dependency pool %s:\n  - %s", d.pool, strings.Join(missing, "\n  - "))
+	}
+	return nil
+}
+
+// fetchDependency downloads dependency from uri to path, or revalidates the
+// copy already there when the dependency asks for it. cached says whether
+// there is such a copy.
+func (d *downloader) fetchDependency(ctx context.Context, dependency Dependency, uri, path string, cached bool) error {
+	timeout, err := dependency.downloadTimeout(d.timeout)
+	if err != nil {
+		return err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx = d.progress.forDependency(ctx, dependency.Name)
+
+	download := d.downloadFromURI
+	if dependency.Revalidate {
+		download = d.revalidateFromURI
+	}
+	if cached {
+		d.logger.Info("Revalidating %s %s from %s", dependency.Name, dependency.Version, uri)
+	} else {
+		d.logger.Info("Downloading %s %s from %s", dependency.Name, dependency.Version, uri)
+	}
+	if uri != dependency.URI {
+		d.logger.Info("  (rewritten from %s)", dependency.URI)
+	}
+	sum, err := download(ctx, uri, path)
+	if err != nil {
+		if !dependency.Revalidate {
+			os.Remove(path)
+		}
+		if timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out downloading %s %s from %s after %s", dependency.Name, dependency.Version, uri, timeout)
+		}
+		return err
+	}
+	if sum == "" {
+		return nil
+	}
+	return writeSidecar(path, sum)
+}
+
+func DownloadFromURI(uri, fileName string) error {
+	d := &downloader{userAgent: DefaultUserAgent}
+	_, err := d.downloadFromURI(context.Background(), uri, fileName)
+	return err
+}
+
+// newRequest builds a GET request for uri carrying the downloader's
+// User-Agent and any .netrc credentials for its host.
+func (d *downloader) newRequest(ctx context.Context, uri string) (*http.Request, error) {
+	return d.newRequestWithMethod(ctx, "GET", uri)
+}
+
+func (d *downloader) newRequestWithMethod(ctx context.Context, method, uri string) (*http.Request, error) {
+	request, err := http.NewRequest(method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.userAgent != "" {
+		request.Header.Set("User-Agent", d.userAgent)
+	}
+	if login, password, ok := d.netrc.lookup(request.URL.Hostname()); ok {
+		request.SetBasicAuth(login, password)
+	}
+	return request.WithContext(ctx), nil
+}
+
+func (d *downloader) downloadFromURI(ctx context.Context, uri, fileName string) (string, error) {
+	err := os.MkdirAll(filepath.Dir(fileName), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := os.Create(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer output.Close()
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+
+	var source io.ReadCloser
+	expected := int64(-1)
+	// size is what progress is reported against.
+	size := int64(-1)
+
+	if u.Scheme == "file" {
+		file, err := os.Open(d.filePath(u))
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		source = file
+		if info, err := file.Stat(); err == nil {
+			size = info.Size()
+		}
+	} else {
+		request, err := d.newRequest(ctx, uri)
+		if err != nil {
+			return "", err
+		}
+		response, err := d.httpClient().Do(request)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		source = response.Body
+		expected, size = response.ContentLength, response.ContentLength
+
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return "", DownloadError{URI: uri, StatusCode: response.StatusCode}
+		}
+	}
+
+	limited, err := d.limitSize(source, uri, size)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if err := copyDownload(io.MultiWriter(output, hash), d.throttle(ctx, trackProgress(ctx, limited, size)), uri, expected); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// limitSize fails reads from r, the download of uri, once they go past
+// d.maxSize. It fails at once when size, the length of the download if
+// known, is already too large.
+func (d *downloader) limitSize(r io.Reader, uri string, size int64) (io.Reader, error) {
+	if d.maxSize <= 0 {
+		return r, nil
+	}
+	if size > d.maxSize {
+		return nil, sizeError(uri, d.maxSize)
+	}
+	return &sizeLimitedReader{r: r, uri: uri, max: d.maxSize}, nil
+}
+
+func sizeError(uri string, max int64) error {
+	return fmt.Errorf("dependency exceeds max size: %s is larger than %d bytes", uri, max)
+}
+
+type sizeLimitedReader struct {
+	r    io.Reader
+	uri  string
+	max  int64
+	read int64
+}
+
+func (l *sizeLimitedReader) Read(b []byte) (int, error) {
+	n, err := l.r.Read(b)
+	l.read += int64(n)
+	if l.read > l.max {
+		return n, sizeError(l.uri, l.max)
+	}
+	return n, err
+}
+
+// sidecarPath is where the sha256 of a downloaded file is recorded, so that
+// a cached copy that has since changed on disk is not trusted.
+func sidecarPath(fileName string) string {
+	return fileName + ".sha256"
+}
+
+func writeSidecar(fileName, sum string) error {
+	return ioutil.WriteFile(sidecarPath(fileName), []byte(sum+"\n"), 0644)
+}
+
+// checkSidecar returns the sha256 recorded for the file at path when it was
+// downloaded, and whether the file still has it. Files cached without a
+// sidecar record nothing and are not considered corrupt; they are verified
+// like any other.
+func checkSidecar(path string) (string, bool) {
+	data, err := ioutil.ReadFile(sidecarPath(path))
+	if err != nil {
+		return "", true
+	}
+	recorded := strings.TrimSpace(string(data))
+	actual, err := sha256File(path)
+	return recorded, err == nil && actual == recorded
+}
+
+// throttle limits reads from r to d.maxBytesPerSecond.
+func (d *downloader) throttle(ctx context.Context, r io.Reader) io.Reader {
+	if d.maxBytesPerSecond <= 0 {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, rate: d.maxBytesPerSecond, start: time.Now()}
+}
+
+// throttledReader sleeps between reads so that the average rate since the
+// first read stays at or below rate bytes per second.
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Read at most a tenth of a second's worth at a time so the transfer
+	// is smooth rather than bursty.
+	if max := t.rate / 10; max > 0 && int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+
+	due := t.start.Add(time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// copyDownload copies a download to output, rejecting empty bodies and
+// bodies whose size differs from the expected Content-Length. A negative
+// expected size is not checked.
+func copyDownload(output io.Writer, source io.Reader, uri string, expected int64) error {
+	n, err := io.Copy(output, source)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("empty response from %s", uri)
+	}
+	if expected >= 0 && n != expected {
+		return fmt.Errorf("incomplete response from %s: expected %d bytes, got %d", uri, expected, n)
+	}
+	return nil
+}
+
+// fetchManifest copies the manifest at source, a path or an http(s) URL,
+// into a new temporary directory, which it returns.
+func (d *downloader) fetchManifest(ctx context.Context, source string) (string, error) {
+	dir, err := ioutil.TempDir("", "buildpack-packager-manifest")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "manifest.yml")
+
+	if u, parseErr := url.Parse(source); parseErr == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		if d.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d.timeout)
+			defer cancel()
+		}
+		_, err = d.downloadFromURI(ctx, source, path)
+	} else {
+		err = libbuildpack.CopyFile(source, path)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("Failed to fetch manifest %s: %v", source, err)
+	}
+	return dir, nil
+}
+
+// checkURIs sends a HEAD request for each dependency of stack in the
+// manifest in bpDir, or for every dependency when stack is empty, and reports
+// all of those that could not be reached.
+func (d *downloader) checkURIs(ctx context.Context, stack, bpDir string) error {
+	unreachable, err := d.unreachableURIs(ctx, stack, bpDir)
+	if err != nil {
+		return err
+	}
+	if len(unreachable) > 0 {
+		return fmt.Errorf("Unreachable dependency URIs:\n  - %s", strings.Join(unreachable, "\n  - "))
+	}
+	return nil
+}
+
+// unreachableURIs describes each dependency for stack, or for any stack
+// when stack is empty, whose URI does not answer a HEAD request.
+func (d *downloader) unreachableURIs(ctx context.Context, stack, bpDir string) ([]string, error) {
+	manifest, err := readManifest(bpDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var deps []Dependency
+	for _, dep := range manifest.Dependencies {
+		if isFileURI(d.rewriteURI(dep.URI)) {
+			continue
+		}
+		for _, s := range dep.Stacks {
+			if stack == "" || s == stack {
+				deps = append(deps, dep)
+				break
+			}
+		}
+	}
+
+	problems := make([]string, len(deps))
+	semaphore := make(chan struct{}, d.max)
+	var wg sync.WaitGroup
+	for i, dep := range deps {
+		wg.Add(1)
+		go func(i int, dep Dependency) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			if err := d.checkURI(ctx, d.rewriteURI(dep.URI)); err != nil {
+				problems[i] = fmt.Sprintf("%s %s: %s: %v", dep.Name, dep.Version, dep.URI, err)
+			}
+		}(i, dep)
+	}
+	wg.Wait()
+
+	var unreachable []string
+	for _, problem := range problems {
+		if problem != "" {
+			unreachable = append(unreachable, problem)
+		}
+	}
+	return unreachable, nil
+}
+
+func (d *downloader) checkURI(ctx context.Context, uri string) error {
+	request, err := d.newRequestWithMethod(ctx, "HEAD", uri)
+	if err != nil {
+		return err
+	}
+	response, err := d.httpClient().Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 400 {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// cacheValidators are the response headers saved next to a revalidated
+// download, used to make the next request conditional.
+type cacheValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func validatorsPath(fileName string) string {
+	return fileName + ".validators"
+}
+
+// revalidateFromURI downloads uri to fileName unless the server reports, by
+// answering 304 Not Modified to a conditional request, that the copy already
+// at fileName is current. The existing copy is only replaced once the new
+// one has been downloaded completely. It returns the sha256 of what was
+// downloaded, or "" when the copy was current.
+func (d *downloader) revalidateFromURI(ctx context.Context, uri, fileName string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "file" {
+		return d.downloadFromURI(ctx, uri, fileName)
+	}
+
+	request, err := d.newRequest(ctx, uri)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(fileName); err == nil {
+		var validators cacheValidators
+		if data, err := ioutil.ReadFile(validatorsPath(fileName)); err == nil {
+			json.Unmarshal(data, &validators)
+		}
+		if validators.ETag != "" {
+			request.Header.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			request.Header.Set("If-Modified-Since", validators.LastModified)
+		}
+	}
+
+	response, err := d.httpClient().Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		return "", nil
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return "", DownloadError{URI: uri, StatusCode: response.StatusCode}
+	}
+
+	limited, err := d.limitSize(response.Body, uri, response.ContentLength)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return "", err
+	}
+	partial := fileName + ".partial"
+	output, err := os.Create(partial)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if err := copyDownload(io.MultiWriter(output, hash), d.throttle(ctx, trackProgress(ctx, limited, response.ContentLength)), uri, response.ContentLength); err != nil {
+		output.Close()
+		os.Remove(partial)
+		return "", err
+	}
+	if err := output.Close(); err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	if err := os.Rename(partial, fileName); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(cacheValidators{
+		ETag:         response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(validatorsPath(fileName), data, 0644); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func sha256File(filePath string) (string, error) {
+	return hashFileHex(filePath, sha256.New())
+}
+
+func hashFileHex(filePath string, hash hash.Hash) (string, error) {
+	fh, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	if _, err := io.Copy(hash, fh); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checkChecksums verifies filePath against every checksum the dependency
+// declares. A dependency without any is checked against an empty sha256,
+// which always fails.
+func checkChecksums(filePath string, dependency Dependency) error {
+	if dependency.SHA1 == "" && dependency.SHA512 == "" {
+		return checkSha256(filePath, dependency)
+	}
+	if dependency.SHA256 != "" {
+		if err := checkSha256(filePath, dependency); err != nil {
+			return err
+		}
+	}
+	if dependency.SHA512 != "" {
+		if err := checkSha512(filePath, dependency); err != nil {
+			return err
+		}
+	}
+	if dependency.SHA1 != "" {
+		if err := checkSha1(filePath, dependency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkSha256(filePath string, dependency Dependency) error {
+	return checkHash(filePath, dependency, "sha256", sha256.New(), dependency.SHA256)
+}
+
+func checkSha512(filePath string, dependency Dependency) error {
+	return checkHash(filePath, dependency, "sha512", sha512.New(), dependency.SHA512)
+}
+
+func checkSha1(filePath string, dependency Dependency) error {
+	return checkHash(filePath, dependency, "sha1", sha1.New(), dependency.SHA1)
+}
+
+func checkHash(filePath string, dependency Dependency, algorithm string, hash hash.Hash, expected string) error {
+	actual, err := hashFileHex(filePath, hash)
+	if err != nil {
+		return err
+	}
+
+	if actual != expected {
+		return ChecksumMismatchError{Dep: dependency, Algorithm: algorithm, Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+// ChecksumMismatchError reports that the contents of Dep do not have the
+// checksum its manifest entry declares.
+type ChecksumMismatchError struct {
+	Dep       Dependency
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("dependency %s mismatch: expected %s %s, actual %s %s", e.Algorithm, e.Algorithm, e.Expected, e.Algorithm, e.Actual)
+}
+
+// DownloadError reports a request for URI which the server answered with
+// StatusCode rather than the file.
+type DownloadError struct {
+	URI        string
+	StatusCode int
+}
+
+func (e DownloadError) Error() string {
+	return fmt.Sprintf("could not download: %d", e.StatusCode)
+}
+
+// rewriteURI applies the first rewrite rule matching uri.
+func (d *downloader) rewriteURI(uri string) string {
+	for _, rewrite := range d.rewrites {
+		if rewrite.match.MatchString(uri) {
+			return rewrite.match.ReplaceAllString(uri, rewrite.replacement)
+		}
+	}
+	return uri
+}
+
+// filePath is the path of the file a file:// URI refers to. Absolute URIs
+// such as file:///vendor/x.tgz are used as they are, while relative ones,
+// file://./vendor/x.tgz or file:vendor/x.tgz, are resolved against the
+// buildpack directory rather than the current directory.
+func (d *downloader) filePath(u *url.URL) string {
+	var rel string
+	switch {
+	case u.Opaque != "":
+		rel = u.Opaque
+	case u.Host == "." || u.Host == "..":
+		rel = u.Host + u.Path
+	default:
+		return filepath.FromSlash(u.Path)
+	}
+	return filepath.Join(d.bpDir, filepath.FromSlash(rel))
+}
+
+// checkIncludedDependencies verifies the dependencies which the buildpack
+// in dir ships as include files, named by their file or by a file:// uri
+// within the buildpack, against their checksums. They are checked whether
+// or not the buildpack is cached, so that a committed file which has
+// drifted from its recorded digest is caught.
+func (d *downloader) checkIncludedDependencies(dir string, includeFiles []string, deps []Dependency) error {
+	included := map[string]bool{}
+	for _, name := range includeFiles {
+		included[filepath.ToSlash(filepath.Clean(name))] = true
+	}
+
+	var problems includeFileErrors
+	for _, dep := range deps {
+		name, ok := d.includedName(dep, included)
+		if !ok || (d.allowUnchecked && !dep.hasChecksum()) {
+			continue
+		}
+		if err := checkChecksums(filepath.Join(dir, filepath.FromSlash(name)), dep); err != nil {
+			problems = append(problems, fmt.Errorf("include file %s of %s %s: %w", name, dep.Name, dep.Version, err))
+		}
+	}
+	if len(problems) > 0 {
+		return checksumError{problems}
+	}
+	return nil
+}
+
+// includeFileErrors reports every include file that failed verification.
+type includeFileErrors []error
+
+func (e includeFileErrors) Error() string {
+	problems := make([]string, len(e))
+	for i, err := range e {
+		problems[i] = err.Error()
+	}
+	return strings.Join(problems, "; ")
+}
+
+func (e includeFileErrors) Unwrap() []error { return e }
+
+// includedName returns the include file which is dep, if any.
+func (d *downloader) includedName(dep Dependency, included map[string]bool) (string, bool) {
+	if dep.File != "" {
+		name := filepath.ToSlash(filepath.Clean(dep.File))
+		return name, included[name]
+	}
+
+	u, err := url.Parse(d.rewriteURI(dep.URI))
+	if err != nil || u.Scheme != "file" || d.skipFileChecksums {
+		return "", false
+	}
+	bpDir, err := filepath.Abs(d.bpDir)
+	if err != nil {
+		return "", false
+	}
+	path, err := filepath.Abs(d.filePath(u))
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(bpDir, path)
+	if err != nil {
+		return "", false
+	}
+	name := filepath.ToSlash(rel)
+	return name, included[name]
+}
+
+func isFileURI(uri string) bool {
+	u, err := url.Parse(uri)
+	return err == nil && u.Scheme == "file"
+}
+
+// checksumError reports a dependency that failed verification.
+type checksumError struct{ error }
+
+func (e checksumError) Unwrap() error { return e.error }
+
+// DownloadStats describes how a dependency was obtained.
+type DownloadStats struct {
+	// Duration is how long fetching, or finding, and verifying the
+	// dependency took.
+	Duration time.Duration
+	// Bytes is the size of the dependency.
+	Bytes int64
+	// CacheHit is set when the dependency was not downloaded because it was
+	// already cached.
+	CacheHit bool
+}
+
+// downloadDependencies downloads deps with at most d.max downloads in
+// flight, returning their files and stats in the same order as deps.
+// Dependencies that are already cached are verified in the same pool, so
+// their checksums are computed concurrently too.
+//
+// When several downloads fail the error of the first failing dependency is
+// returned, unless every failure is a checksum mismatch, in which case all
+// of them are reported together.
+func (d *downloader) downloadDependencies(ctx context.Context, deps []Dependency) ([]File, []DownloadStats, error) {
+	files := make([]File, len(deps))
+	stats := make([]DownloadStats, len(deps))
+	if d.pool != "" {
+		if err := d.checkPool(deps); err != nil {
+			return nil, nil, err
+		}
+	}
+	if d.progress != nil {
+		d.progress.total = d.expectedBytes(ctx, deps)
+	}
+
+	if d.max <= 1 {
+		var errs []error
+		for i, dep := range deps {
+			file, stat, err := d.downloadDependency(ctx, dep)
+			if err != nil {
+				if !d.keepGoing || ctx.Err() != nil {
+					return nil, nil, err
+				}
+				errs = append(errs, err)
+				continue
+			}
+			files[i], stats[i] = file, stat
+		}
+		if err := allErrors(errs); err != nil {
+			return nil, nil, err
+		}
+		return files, stats, nil
+	}
+
+	parallel := *d
+	parallel.logger = libbuildpack.NewLogger(&lockedWriter{w: d.logger.Output()})
+	errs := make([]error, len(deps))
+
+	// Dependencies sharing a URI share a cache file, and those sharing a
+	// sha256 share a blob, so neither may be downloaded at the same time.
+	// The uri lock is always taken first.
+	uriLocks := map[string]*sync.Mutex{}
+	blobLocks := map[string]*sync.Mutex{}
+	for _, dep := range deps {
+		if uriLocks[dep.URI] == nil {
+			uriLocks[dep.URI] = &sync.Mutex{}
+		}
+		if dep.SHA256 != "" && blobLocks[dep.SHA256] == nil {
+			blobLocks[dep.SHA256] = &sync.Mutex{}
+		}
+	}
+
+	semaphore := make(chan struct{}, d.max)
+	var wg sync.WaitGroup
+	for i, dep := range deps {
+		wg.Add(1)
+		go func(i int, dep Dependency) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			uriLocks[dep.URI].Lock()
+			defer uriLocks[dep.URI].Unlock()
+			if blobLock := blobLocks[dep.SHA256]; blobLock != nil {
+				blobLock.Lock()
+				defer blobLock.Unlock()
+			}
+
+			files[i], stats[i], errs[i] = parallel.downloadDependency(ctx, dep)
+		}(i, dep)
+	}
+	wg.Wait()
+
+	combine := combineErrors
+	if d.keepGoing {
+		combine = allErrors
+	}
+	if err := combine(errs); err != nil {
+		return nil, nil, err
+	}
+	return files, stats, nil
+}
+
+// allErrors reports every error in errs, or just the one when there is
+// only one.
+func allErrors(errs []error) error {
+	var failures []error
+	for _, err := range errs {
+		if err != nil {
+			failures = append(failures, err)
+		}
+	}
+	switch len(failures) {
+	case 0:
+		return nil
+	case 1:
+		return failures[0]
+	}
+	return dependencyErrors{fmt.Sprintf("%d dependencies failed", len(failures)), failures}
+}
+
+// combineErrors returns the first of errs that is not a checksum error or,
+// when there is none, all of the checksum errors.
+func combineErrors(errs []error) error {
+	var mismatches []error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if _, ok := err.(checksumError); !ok {
+			return err
+		}
+		mismatches = append(mismatches, err)
+	}
+	switch len(mismatches) {
+	case 0:
+		return nil
+	case 1:
+		return mismatches[0]
+	}
+	return dependencyErrors{fmt.Sprintf("%d dependencies failed checksum verification", len(mismatches)), mismatches}
+}
+
+// dependencyErrors reports several failed dependencies at once, keeping each
+// of their errors for errors.Is and errors.As.
+type dependencyErrors struct {
+	summary string
+	errs    []error
+}
+
+func (e dependencyErrors) Error() string {
+	failures := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		failures[i] = err.Error()
+	}
+	return fmt.Sprintf("%s:\n  - %s", e.summary, strings.Join(failures, "\n  - "))
+}
+
+func (e dependencyErrors) Unwrap() []error { return e.errs }
+
+type lockedWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.w.Write(p)
+}
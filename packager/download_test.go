@@ -0,0 +1,1336 @@
+package packager_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/libbuildpack/packager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Downloading dependencies", func() {
+	var (
+		mutex    sync.Mutex
+		bpDir    string
+		cacheDir string
+		server   *httptest.Server
+		handler  http.HandlerFunc
+		zipFile  string
+	)
+
+	// writeBuildpack creates a buildpack whose dependencies are served by
+	// the test server at /dep-1 ... /dep-count.
+	writeBuildpack := func(count int) {
+		var manifest strings.Builder
+		manifest.WriteString("---\nlanguage: ruby\ndefault_versions: []\ninclude_files:\n- manifest.yml\ndependencies:\n")
+		for i := 1; i <= count; i++ {
+			fmt.Fprintf(&manifest, "- name: dep-%d\n  version: 1.0.0\n  uri: %s/dep-%d\n  sha256: %x\n  cf_stacks: [cflinuxfs3]\n",
+				i, server.URL, i, sha256.Sum256([]byte(fmt.Sprintf("/dep-%d", i))))
+		}
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), []byte(manifest.String()), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		bpDir, err = ioutil.TempDir("", "packager-download-bp")
+		Expect(err).NotTo(HaveOccurred())
+		cacheDir, err = ioutil.TempDir("", "packager-download-cache")
+		Expect(err).NotTo(HaveOccurred())
+
+		// By default each dependency's content is its own path.
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.URL.Path)
+		}
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler(w, r)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(bpDir)
+		os.RemoveAll(cacheDir)
+	})
+
+	packageWith := func(options packager.PackageOptions) (packager.Result, error) {
+		options.BuildpackDir = bpDir
+		options.CacheDir = cacheDir
+		options.Version = "1.2.3"
+		options.Stack = "cflinuxfs3"
+		options.Cached = true
+		result, err := packager.PackageWithOptions(options)
+		zipFile = result.ZipFile
+		return result, err
+	}
+
+	Context("with a concurrency limit", func() {
+		var (
+			inFlight int
+			peak     int
+		)
+
+		BeforeEach(func() {
+			inFlight, peak = 0, 0
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				inFlight++
+				if inFlight > peak {
+					peak = inFlight
+				}
+				mutex.Unlock()
+
+				time.Sleep(50 * time.Millisecond)
+				fmt.Fprint(w, r.URL.Path)
+
+				mutex.Lock()
+				inFlight--
+				mutex.Unlock()
+			}
+			writeBuildpack(6)
+		})
+
+		It("never has more than the limit in flight", func() {
+			result, err := packageWith(packager.PackageOptions{MaxConcurrentDownloads: 2})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(peak).To(Equal(2))
+
+			Expect(result.Files).To(HaveLen(7))
+			for i := 1; i <= 6; i++ {
+				Expect(result.Files[i]).To(HaveSuffix(fmt.Sprintf("/dep-%d", i)))
+				Expect(ZipContents(zipFile, result.Files[i])).To(Equal(fmt.Sprintf("/dep-%d", i)))
+			}
+		})
+
+		It("downloads serially when the limit is one", func() {
+			_, err := packageWith(packager.PackageOptions{MaxConcurrentDownloads: 1})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(peak).To(Equal(1))
+		})
+
+		It("verifies cached dependencies concurrently and reports every mismatch", func() {
+			_, err := packageWith(packager.PackageOptions{MaxConcurrentDownloads: 3})
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, i := range []int{2, 4} {
+				path := filepath.Join(cacheDir, "dependencies", fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s/dep-%d", server.URL, i)))), fmt.Sprintf("dep-%d", i))
+				Expect(ioutil.WriteFile(path, []byte("corrupt"), 0644)).To(Succeed())
+				Expect(os.Remove(path + ".sha256")).To(Succeed())
+			}
+			// Downloading them again does not help either.
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/dep-2" || r.URL.Path == "/dep-4" {
+					fmt.Fprint(w, "corrupt")
+					return
+				}
+				fmt.Fprint(w, r.URL.Path)
+			}
+
+			_, err = packageWith(packager.PackageOptions{MaxConcurrentDownloads: 3})
+			Expect(err).To(MatchError(HavePrefix("2 dependencies failed checksum verification:\n  - dep-2 1.0.0 from ")))
+			Expect(err.Error()).To(ContainSubstring("\n  - dep-4 1.0.0 from "))
+
+			var mismatch packager.ChecksumMismatchError
+			Expect(errors.As(err, &mismatch)).To(BeTrue())
+			Expect(mismatch.Dep.Name).To(Or(Equal("dep-2"), Equal("dep-4")))
+		})
+
+		It("reports every failure when asked to keep going", func() {
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/dep-2":
+					w.WriteHeader(http.StatusNotFound)
+				case "/dep-5":
+					fmt.Fprint(w, "corrupt")
+				default:
+					fmt.Fprint(w, r.URL.Path)
+				}
+			}
+
+			for _, max := range []int{1, 3} {
+				_, err := packageWith(packager.PackageOptions{MaxConcurrentDownloads: max, KeepGoing: true})
+				Expect(err).To(MatchError(HavePrefix("2 dependencies failed:\n  - could not download: 404\n  - dep-5 1.0.0 from ")))
+
+				var downloadErr packager.DownloadError
+				Expect(errors.As(err, &downloadErr)).To(BeTrue())
+				Expect(downloadErr).To(Equal(packager.DownloadError{URI: server.URL + "/dep-2", StatusCode: http.StatusNotFound}))
+				var mismatch packager.ChecksumMismatchError
+				Expect(errors.As(err, &mismatch)).To(BeTrue())
+				Expect(mismatch.Dep.Name).To(Equal("dep-5"))
+			}
+		})
+
+		It("reports the first failing dependency", func() {
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/dep-2" || r.URL.Path == "/dep-5" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				fmt.Fprint(w, r.URL.Path)
+			}
+
+			_, err := packageWith(packager.PackageOptions{MaxConcurrentDownloads: 3})
+			Expect(err).To(MatchError("could not download: 404"))
+
+			var downloadErr packager.DownloadError
+			Expect(errors.As(err, &downloadErr)).To(BeTrue())
+			Expect(downloadErr.StatusCode).To(Equal(http.StatusNotFound))
+			Expect(downloadErr.URI).To(Or(Equal(server.URL+"/dep-2"), Equal(server.URL+"/dep-5")))
+		})
+	})
+
+	Context("checking URIs", func() {
+		var methods []string
+		BeforeEach(func() {
+			methods = nil
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				methods = append(methods, r.Method)
+				mutex.Unlock()
+				if r.URL.Path == "/dep-2" || r.URL.Path == "/dep-3" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				fmt.Fprint(w, r.URL.Path)
+			}
+			writeBuildpack(3)
+		})
+
+		It("reports every unreachable dependency before downloading", func() {
+			_, err := packageWith(packager.PackageOptions{CheckURIs: true})
+			Expect(err).To(MatchError(fmt.Sprintf("Unreachable dependency URIs:\n  - dep-2 1.0.0: %[1]s/dep-2: status 404\n  - dep-3 1.0.0: %[1]s/dep-3: status 404", server.URL)))
+			Expect(methods).To(Equal([]string{"HEAD", "HEAD", "HEAD"}))
+		})
+
+		It("does not check file URIs", func() {
+			writeBuildpack(1)
+			manifest, err := ioutil.ReadFile(filepath.Join(bpDir, "manifest.yml"))
+			Expect(err).NotTo(HaveOccurred())
+			manifest = []byte(strings.Replace(string(manifest), server.URL, "file://"+bpDir, 1))
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), manifest, 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, "dep-1"), []byte("/dep-1"), 0644)).To(Succeed())
+
+			_, err = packageWith(packager.PackageOptions{CheckURIs: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(methods).To(BeEmpty())
+		})
+	})
+
+	Describe("DownloadDependency", func() {
+		var dep packager.Dependency
+		BeforeEach(func() {
+			dep = packager.Dependency{
+				Name:    "dep-1",
+				Version: "1.0.0",
+				URI:     server.URL + "/dep-1",
+				SHA256:  fmt.Sprintf("%x", sha256.Sum256([]byte("/dep-1"))),
+			}
+		})
+
+		It("downloads a dependency into the cache", func() {
+			file, err := packager.Packager{Stdout: ioutil.Discard, CacheDir: cacheDir}.DownloadDependency(context.Background(), dep, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Path).To(Equal(packager.CachePath(dep, cacheDir)))
+			Expect(ioutil.ReadFile(file.Path)).To(Equal([]byte("/dep-1")))
+			Expect(file.Name).To(Equal(filepath.Join("dependencies", fmt.Sprintf("%x", md5.Sum([]byte(dep.URI))), "dep-1")))
+		})
+
+		It("uses a dependency already at its cache path", func() {
+			path := packager.CachePath(dep, cacheDir)
+			Expect(path).To(Equal(filepath.Join(cacheDir, "dependencies", fmt.Sprintf("%x", sha256.Sum256([]byte(dep.URI))), "dep-1")))
+			Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(path, []byte("/dep-1"), 0644)).To(Succeed())
+			server.Close()
+
+			file, err := packager.Packager{Stdout: ioutil.Discard}.DownloadDependency(context.Background(), dep, cacheDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Path).To(Equal(path))
+		})
+
+		It("verifies the sha256", func() {
+			dep.SHA256 = "fffffff"
+			_, err := packager.Packager{Stdout: ioutil.Discard}.DownloadDependency(context.Background(), dep, cacheDir)
+			Expect(err).To(MatchError(ContainSubstring("dependency sha256 mismatch")))
+		})
+
+		It("verifies every checksum the dependency declares", func() {
+			dep.SHA512 = fmt.Sprintf("%x", sha512.Sum512([]byte("/dep-1")))
+			dep.SHA1 = fmt.Sprintf("%x", sha1.Sum([]byte("/dep-1")))
+			_, err := packager.Packager{Stdout: ioutil.Discard}.DownloadDependency(context.Background(), dep, cacheDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			dep.SHA1 = "fffffff"
+			_, err = packager.Packager{Stdout: ioutil.Discard}.DownloadDependency(context.Background(), dep, cacheDir)
+			Expect(err).To(MatchError(ContainSubstring("dependency sha1 mismatch: expected sha1 fffffff, actual sha1 ")))
+
+			var mismatch packager.ChecksumMismatchError
+			Expect(errors.As(err, &mismatch)).To(BeTrue())
+			Expect(mismatch.Dep.Name).To(Equal("dep-1"))
+			Expect(mismatch.Algorithm).To(Equal("sha1"))
+			Expect(mismatch.Expected).To(Equal("fffffff"))
+			Expect(mismatch.Actual).To(Equal(fmt.Sprintf("%x", sha1.Sum([]byte("/dep-1")))))
+		})
+
+		It("verifies a dependency with only a sha512", func() {
+			dep.SHA256 = ""
+			dep.SHA512 = "fffffff"
+			_, err := packager.Packager{Stdout: ioutil.Discard}.DownloadDependency(context.Background(), dep, cacheDir)
+			Expect(err).To(MatchError(ContainSubstring("dependency sha512 mismatch")))
+		})
+
+		It("stops when the context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := packager.Packager{Stdout: ioutil.Discard}.DownloadDependency(ctx, dep, cacheDir)
+			Expect(err).To(MatchError(ContainSubstring("context canceled")))
+		})
+
+		It("returns an error when the cache directory cannot be created", func() {
+			blocker := filepath.Join(cacheDir, "blocker")
+			Expect(ioutil.WriteFile(blocker, nil, 0644)).To(Succeed())
+
+			_, err := packager.Packager{Stdout: ioutil.Discard}.DownloadDependency(context.Background(), dep, filepath.Join(blocker, "cache"))
+			Expect(err).To(MatchError(HavePrefix("Failed to create cache directory " + filepath.Join(blocker, "cache") + ": ")))
+		})
+	})
+
+	Context("with dependencies shipped as include files", func() {
+		writeIncluded := func(uri, sha string) {
+			Expect(os.MkdirAll(filepath.Join(bpDir, "bin"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, "bin", "tool"), []byte("tool v2"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), []byte(fmt.Sprintf(`---
+language: ruby
+default_versions: []
+include_files:
+- manifest.yml
+- bin/tool
+dependencies:
+- name: tool
+  version: 1.0.0
+  %s
+  sha256: %s
+  cf_stacks: [cflinuxfs3]
+`, uri, sha)), 0644)).To(Succeed())
+		}
+		packageUncached := func() error {
+			result, err := packager.PackageWithOptions(packager.PackageOptions{
+				BuildpackDir: bpDir,
+				CacheDir:     cacheDir,
+				Version:      "1.2.3",
+				Stack:        "cflinuxfs3",
+			})
+			os.Remove(result.ZipFile)
+			return err
+		}
+
+		It("verifies a dependency named by its file", func() {
+			writeIncluded("file: bin/tool\n  uri: "+server.URL+"/tool", fmt.Sprintf("%x", sha256.Sum256([]byte("tool v1"))))
+			Expect(packageUncached()).To(MatchError(HavePrefix("include file bin/tool of tool 1.0.0: dependency sha256 mismatch")))
+		})
+
+		It("verifies a dependency with a file:// uri within the buildpack", func() {
+			writeIncluded("uri: file://./bin/tool", fmt.Sprintf("%x", sha256.Sum256([]byte("tool v1"))))
+			Expect(packageUncached()).To(MatchError(HavePrefix("include file bin/tool of tool 1.0.0: dependency sha256 mismatch")))
+		})
+
+		It("accepts an include file which matches", func() {
+			writeIncluded("uri: file://./bin/tool", fmt.Sprintf("%x", sha256.Sum256([]byte("tool v2"))))
+			Expect(packageUncached()).To(Succeed())
+		})
+	})
+
+	Context("with a dependency pool", func() {
+		var pool string
+		BeforeEach(func() {
+			writeBuildpack(2)
+			var err error
+			pool, err = ioutil.TempDir("", "packager-download-pool")
+			Expect(err).NotTo(HaveOccurred())
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				Fail("requested " + r.URL.Path)
+			}
+		})
+		AfterEach(func() { os.RemoveAll(pool) })
+
+		It("packages the dependencies found in it without downloading them", func() {
+			Expect(ioutil.WriteFile(filepath.Join(pool, "dep-1"), []byte("/dep-1"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(pool, "second.tgz"), []byte("/dep-2"), 0644)).To(Succeed())
+
+			result, err := packageWith(packager.PackageOptions{
+				DependencyPool:      pool,
+				DependencyPoolNames: map[string]string{"dep-2@1.0.0": "second.tgz"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			for i := 1; i <= 2; i++ {
+				name := fmt.Sprintf("dependencies/%x/dep-%d", md5.Sum([]byte(fmt.Sprintf("%s/dep-%d", server.URL, i))), i)
+				Expect(ZipContents(zipFile, name)).To(Equal(fmt.Sprintf("/dep-%d", i)))
+			}
+			Expect(result.Dependencies[0].Download.CacheHit).To(BeTrue())
+			Expect(filepath.Join(cacheDir, "dependencies")).NotTo(BeADirectory())
+		})
+
+		It("lists every dependency missing from it", func() {
+			_, err := packageWith(packager.PackageOptions{DependencyPool: pool})
+			Expect(err).To(MatchError(fmt.Sprintf("Dependencies not found in dependency pool %s:\n  - dep-1 1.0.0 (dep-1)\n  - dep-2 1.0.0 (dep-2)", pool)))
+		})
+
+		It("verifies what it finds", func() {
+			Expect(ioutil.WriteFile(filepath.Join(pool, "dep-1"), []byte("/dep-1"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(pool, "dep-2"), []byte("tampered"), 0644)).To(Succeed())
+
+			_, err := packageWith(packager.PackageOptions{DependencyPool: pool})
+			Expect(err).To(MatchError(ContainSubstring("dep-2 1.0.0 from dependency pool (" + filepath.Join(pool, "dep-2") + "): dependency sha256 mismatch")))
+		})
+	})
+
+	Context("packaging verbosely", func() {
+		BeforeEach(func() {
+			writeBuildpack(2)
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, ".buildpackignore"), []byte("notes.txt\n"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, "notes.txt"), []byte("notes"), 0644)).To(Succeed())
+		})
+
+		packageLogging := func(verbose bool) string {
+			buffer := new(bytes.Buffer)
+			_, err := packageWith(packager.PackageOptions{
+				Logger:              libbuildpack.NewLogger(buffer),
+				Verbose:             verbose,
+				ExcludeDependencies: []string{"dep-2"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return buffer.String()
+		}
+
+		It("logs how each dependency and file was handled", func() {
+			out := packageLogging(true)
+			Expect(out).To(ContainSubstring("dep-1 1.0.0: cache miss, fetched " + server.URL + "/dep-1 to "))
+			Expect(out).To(ContainSubstring("Leaving out dep-2 1.0.0: excluded"))
+			Expect(out).To(ContainSubstring("Skipping 'notes.txt': ignored by .buildpackignore"))
+			Expect(out).To(ContainSubstring("Zipped manifest.yml: deflated"))
+
+			Expect(packageLogging(true)).To(ContainSubstring("dep-1 1.0.0: cache hit at "))
+		})
+
+		It("logs none of it by default", func() {
+			out := packageLogging(false)
+			Expect(out).NotTo(ContainSubstring("cache miss"))
+			Expect(out).NotTo(ContainSubstring("Skipping"))
+			Expect(out).NotTo(ContainSubstring("Zipped"))
+		})
+	})
+
+	Context("excluding dependencies", func() {
+		var requested []string
+		BeforeEach(func() {
+			writeBuildpack(3)
+			requested = nil
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				requested = append(requested, r.URL.Path)
+				mutex.Unlock()
+				fmt.Fprint(w, r.URL.Path)
+			}
+		})
+
+		It("leaves them out of the zip and its manifest without downloading them", func() {
+			result, err := packageWith(packager.PackageOptions{ExcludeDependencies: []string{"dep-1@1.0.0", "dep-3"}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(requested).To(Equal([]string{"/dep-2"}))
+			Expect(result.Dependencies).To(HaveLen(1))
+			Expect(result.Dependencies[0].Name).To(Equal("dep-2"))
+
+			manifestYml, err := ZipContents(zipFile, "manifest.yml")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifestYml).To(ContainSubstring("dep-2"))
+			Expect(manifestYml).NotTo(ContainSubstring("dep-1"))
+			Expect(manifestYml).NotTo(ContainSubstring("dep-3"))
+		})
+
+		It("fails when an exclude matches no dependency", func() {
+			_, err := packageWith(packager.PackageOptions{ExcludeDependencies: []string{"dep-1@2.0.0", "dep-4"}})
+			Expect(err).To(MatchError("Excluded dependencies not found in manifest: dep-1@2.0.0, dep-4"))
+			Expect(requested).To(BeEmpty())
+		})
+	})
+
+	Context("with events requested", func() {
+		BeforeEach(func() { writeBuildpack(2) })
+
+		It("emits each download event as soon as the dependency is downloaded", func() {
+			events := eventRecorder(make(chan packager.Event, 16))
+			var before []packager.Event
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/dep-2" {
+					select {
+					case event := <-events:
+						before = append(before, event)
+					case <-time.After(5 * time.Second):
+					}
+				}
+				fmt.Fprint(w, r.URL.Path)
+			}
+
+			_, err := packageWith(packager.PackageOptions{MaxConcurrentDownloads: 1, Events: events})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(before).To(Equal([]packager.Event{{Event: "download", Dep: "dep-1", Bytes: 6}}))
+		})
+	})
+
+	Context("with extra dependencies", func() {
+		var extra packager.Dependency
+		BeforeEach(func() {
+			writeBuildpack(1)
+			extra = packager.Dependency{
+				Name:    "org-tool",
+				Version: "2.0.0",
+				URI:     server.URL + "/org-tool",
+				SHA256:  fmt.Sprintf("%x", sha256.Sum256([]byte("/org-tool"))),
+			}
+		})
+
+		It("adds them to the zip alongside the manifest's dependencies", func() {
+			result, err := packageWith(packager.PackageOptions{ExtraDependencies: []packager.Dependency{extra}})
+			Expect(err).NotTo(HaveOccurred())
+
+			name := fmt.Sprintf("dependencies/%x/org-tool", md5.Sum([]byte(extra.URI)))
+			Expect(ZipContents(zipFile, name)).To(Equal("/org-tool"))
+			Expect(result.Files).To(ContainElement(fmt.Sprintf("dependencies/%x/dep-1", md5.Sum([]byte(server.URL+"/dep-1")))))
+			Expect(result.Dependencies).To(HaveLen(2))
+			Expect(result.Dependencies[1].Name).To(Equal("org-tool"))
+
+			manifestYml, err := ZipContents(zipFile, "manifest.yml")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifestYml).NotTo(ContainSubstring("org-tool"))
+
+			err = packager.VerifyZip(zipFile, filepath.Join(bpDir, "manifest.yml"))
+			Expect(err).To(BeAssignableToTypeOf(packager.ZipMismatchError{}))
+			Expect(err.(packager.ZipMismatchError).Problems).To(Equal([]string{"unexpected dependency file " + name}))
+		})
+
+		It("adds them to uncached buildpacks", func() {
+			result, err := packager.PackageWithOptions(packager.PackageOptions{
+				BuildpackDir:      bpDir,
+				CacheDir:          cacheDir,
+				Version:           "1.2.3",
+				Stack:             "cflinuxfs3",
+				ExtraDependencies: []packager.Dependency{extra},
+				ReleaseSummary:    true,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(result.ZipFile)
+			defer os.Remove(result.ReleaseSummaryFile)
+			Expect(result.Files).To(ContainElement(fmt.Sprintf("dependencies/%x/org-tool", md5.Sum([]byte(extra.URI)))))
+			Expect(result.Files).NotTo(ContainElement(fmt.Sprintf("dependencies/%x/dep-1", md5.Sum([]byte(server.URL+"/dep-1")))))
+
+			data, err := ioutil.ReadFile(result.ReleaseSummaryFile)
+			Expect(err).NotTo(HaveOccurred())
+			var summary packager.ReleaseSummary
+			Expect(json.Unmarshal(data, &summary)).To(Succeed())
+			Expect(summary.Dependencies).To(HaveLen(2))
+			Expect(summary.Dependencies[0].Name).To(Equal("dep-1"))
+			Expect(summary.Dependencies[0].Cached).To(BeFalse())
+			Expect(summary.Dependencies[1].Name).To(Equal("org-tool"))
+			Expect(summary.Dependencies[1].Cached).To(BeTrue())
+		})
+
+		It("verifies them", func() {
+			extra.SHA256 = "fffffff"
+			_, err := packageWith(packager.PackageOptions{ExtraDependencies: []packager.Dependency{extra}})
+			Expect(err).To(MatchError(ContainSubstring("dependency sha256 mismatch")))
+		})
+	})
+
+	Context("with a checksum index", func() {
+		BeforeEach(func() { writeBuildpack(3) })
+
+		It("lists the sha256 of every dependency in the zip", func() {
+			result, err := packageWith(packager.PackageOptions{ChecksumIndex: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Files).To(ContainElement(packager.ChecksumIndexName))
+
+			var lines []string
+			for i := 1; i <= 3; i++ {
+				path := fmt.Sprintf("/dep-%d", i)
+				lines = append(lines, fmt.Sprintf("%x  %x%s\n", sha256.Sum256([]byte(path)), md5.Sum([]byte(server.URL+path)), path))
+			}
+			sort.Slice(lines, func(i, j int) bool { return lines[i][66:] < lines[j][66:] })
+			Expect(ZipContents(zipFile, packager.ChecksumIndexName)).To(Equal(strings.Join(lines, "")))
+		})
+
+		It("passes verification", func() {
+			_, err := packageWith(packager.PackageOptions{ChecksumIndex: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(packager.VerifyZip(zipFile, filepath.Join(bpDir, "manifest.yml"))).To(Succeed())
+		})
+
+		It("is left out of uncached buildpacks", func() {
+			result, err := packager.PackageWithOptions(packager.PackageOptions{
+				BuildpackDir:  bpDir,
+				CacheDir:      cacheDir,
+				Version:       "1.2.3",
+				Stack:         "cflinuxfs3",
+				ChecksumIndex: true,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(result.ZipFile)
+			Expect(result.Files).NotTo(ContainElement(packager.ChecksumIndexName))
+		})
+	})
+
+	Context("reporting progress", func() {
+		var updates []packager.Progress
+		BeforeEach(func() {
+			updates = nil
+			writeBuildpack(3)
+		})
+		record := func(p packager.Progress) { updates = append(updates, p) }
+
+		It("reports the overall total of the dependencies to download", func() {
+			_, err := packageWith(packager.PackageOptions{OnProgress: record})
+			Expect(err).NotTo(HaveOccurred())
+
+			total := int64(len("/dep-1") * 3)
+			Expect(updates).NotTo(BeEmpty())
+			for _, update := range updates {
+				Expect(update.Total).To(Equal(int64(len("/dep-1"))))
+				Expect(update.OverallTotal).To(Equal(total))
+			}
+			Expect(updates[len(updates)-1].OverallBytes).To(Equal(total))
+
+			// Nothing is left to download once everything is cached.
+			updates = nil
+			_, err = packageWith(packager.PackageOptions{OnProgress: record})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updates).To(BeEmpty())
+		})
+
+		It("reports only each dependency when sizes are unknown", func() {
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				// Flushing first sends the body without a Content-Length.
+				w.(http.Flusher).Flush()
+				fmt.Fprint(w, r.URL.Path)
+			}
+
+			_, err := packageWith(packager.PackageOptions{OnProgress: record, MaxConcurrentDownloads: 1})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updates).To(HaveLen(3))
+			for i, update := range updates {
+				Expect(update).To(Equal(packager.Progress{
+					Dep:          fmt.Sprintf("dep-%d", i+1),
+					Bytes:        int64(len("/dep-1")),
+					Total:        -1,
+					OverallBytes: int64(len("/dep-1") * (i + 1)),
+					OverallTotal: -1,
+				}))
+			}
+		})
+	})
+
+	It("reuses connections across downloads", func() {
+		remotes := map[string]bool{}
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			remotes[r.RemoteAddr] = true
+			mutex.Unlock()
+			fmt.Fprint(w, r.URL.Path)
+		}
+		writeBuildpack(5)
+
+		_, err := packageWith(packager.PackageOptions{MaxConcurrentDownloads: 1})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(remotes).To(HaveLen(1))
+	})
+
+	It("uses the given HTTP client", func() {
+		writeBuildpack(1)
+		manifest, err := ioutil.ReadFile(filepath.Join(bpDir, "manifest.yml"))
+		Expect(err).NotTo(HaveOccurred())
+		manifest = []byte(strings.Replace(string(manifest), server.URL, "http://mirror.invalid", 1))
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), manifest, 0644)).To(Succeed())
+
+		client := &http.Client{Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Body:          ioutil.NopCloser(strings.NewReader(r.URL.Path)),
+				ContentLength: int64(len(r.URL.Path)),
+				Request:       r,
+			}, nil
+		})}
+
+		result, err := packageWith(packager.PackageOptions{HTTPClient: client})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ZipContents(zipFile, result.Files[1])).To(Equal("/dep-1"))
+	})
+
+	It("limits the download rate", func() {
+		content := strings.Repeat("x", 2000)
+		handler = func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, content) }
+		writeBuildpack(1)
+		manifest, err := ioutil.ReadFile(filepath.Join(bpDir, "manifest.yml"))
+		Expect(err).NotTo(HaveOccurred())
+		manifest = []byte(strings.Replace(string(manifest), fmt.Sprintf("%x", sha256.Sum256([]byte("/dep-1"))), fmt.Sprintf("%x", sha256.Sum256([]byte(content))), 1))
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), manifest, 0644)).To(Succeed())
+
+		start := time.Now()
+		_, err = packageWith(packager.PackageOptions{MaxBytesPerSecond: 4000})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+	})
+
+	Context("with a size limit", func() {
+		BeforeEach(func() { writeBuildpack(1) })
+
+		It("downloads dependencies within it", func() {
+			_, err := packageWith(packager.PackageOptions{MaxDependencySize: 6})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("refuses a response whose Content-Length is too large", func() {
+			_, err := packageWith(packager.PackageOptions{MaxDependencySize: 5})
+			Expect(err).To(MatchError(ContainSubstring("dependency exceeds max size: " + server.URL + "/dep-1 is larger than 5 bytes")))
+		})
+
+		It("stops reading a response of unknown length once it is too large", func() {
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < 10; i++ {
+					fmt.Fprint(w, "chunk")
+					w.(http.Flusher).Flush()
+				}
+			}
+			_, err := packageWith(packager.PackageOptions{MaxDependencySize: 20})
+			Expect(err).To(MatchError(ContainSubstring("dependency exceeds max size")))
+
+			matches, err := filepath.Glob(filepath.Join(cacheDir, "dependencies", "*", "dep-1"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(matches).To(BeEmpty())
+		})
+	})
+
+	Context("with a remote manifest", func() {
+		var manifest []byte
+		BeforeEach(func() {
+			writeBuildpack(1)
+			var err error
+			manifest, err = ioutil.ReadFile(filepath.Join(bpDir, "manifest.yml"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), []byte("---\nlanguage: broken\n"), 0644)).To(Succeed())
+
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/manifest.yml":
+					w.Write(manifest)
+				case strings.HasPrefix(r.URL.Path, "/dep-"):
+					fmt.Fprint(w, r.URL.Path)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}
+		})
+
+		It("packages the manifest from the URL", func() {
+			result, err := packageWith(packager.PackageOptions{ManifestSource: server.URL + "/manifest.yml"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Base(zipFile)).To(Equal("ruby_buildpack-cached-cflinuxfs3-v1.2.3.zip"))
+			Expect(ZipContents(zipFile, result.Files[1])).To(Equal("/dep-1"))
+			Expect(ZipContents(zipFile, "manifest.yml")).To(ContainSubstring("name: dep-1"))
+		})
+
+		It("reports a manifest that cannot be fetched", func() {
+			_, err := packageWith(packager.PackageOptions{ManifestSource: server.URL + "/missing.yml"})
+			Expect(err).To(MatchError("Failed to fetch manifest " + server.URL + "/missing.yml: could not download: 404"))
+		})
+	})
+
+	It("reports an empty response", func() {
+		handler = func(w http.ResponseWriter, r *http.Request) {}
+		writeBuildpack(1)
+
+		_, err := packageWith(packager.PackageOptions{})
+		Expect(err).To(MatchError("empty response from " + server.URL + "/dep-1"))
+	})
+
+	It("names the dependency whose checksum does not match", func() {
+		handler = func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "unexpected") }
+		writeBuildpack(2)
+
+		path := filepath.Join(cacheDir, "dependencies", fmt.Sprintf("%x", sha256.Sum256([]byte(server.URL+"/dep-1"))), "dep-1")
+		_, err := packageWith(packager.PackageOptions{MaxConcurrentDownloads: 1})
+		Expect(err).To(MatchError(HavePrefix(fmt.Sprintf("dep-1 1.0.0 from %s/dep-1 (cached at %s): dependency sha256 mismatch", server.URL, path))))
+	})
+
+	It("keeps the caches of concurrent packagers apart", func() {
+		writeBuildpack(2)
+		otherCacheDir, err := ioutil.TempDir("", "packager-download-cache")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(otherCacheDir)
+
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i, dir := range []string{cacheDir, otherCacheDir} {
+			wg.Add(1)
+			go func(i int, dir string) {
+				defer wg.Done()
+				defer GinkgoRecover()
+				_, errs[i] = packager.Packager{Stdout: ioutil.Discard, CacheDir: dir}.PackageToWriter(packager.PackageOptions{
+					BuildpackDir: bpDir,
+					Version:      "1.2.3",
+					Stack:        "cflinuxfs3",
+					Cached:       true,
+				}, ioutil.Discard)
+			}(i, dir)
+		}
+		wg.Wait()
+		Expect(errs).To(Equal([]error{nil, nil}))
+
+		for _, dir := range []string{cacheDir, otherCacheDir} {
+			dep := packager.Dependency{Name: "dep-1", URI: server.URL + "/dep-1"}
+			Expect(packager.CachePath(dep, dir)).To(BeARegularFile())
+		}
+	})
+
+	Context("with URI rewrites", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), []byte(fmt.Sprintf(`---
+language: ruby
+default_versions: []
+dependencies:
+- name: dep-1
+  version: 1.0.0
+  uri: https://upstream.example.com/files/dep-1
+  sha256: %x
+  cf_stacks: [cflinuxfs3]
+`, sha256.Sum256([]byte("/dep-1")))), 0644)).To(Succeed())
+		})
+
+		It("downloads from the rewritten URI and caches under the original", func() {
+			var out bytes.Buffer
+			result, err := packageWith(packager.PackageOptions{
+				URIRewrites: []packager.URIRewrite{
+					{Match: `^https://other\.example\.com/`, Replacement: "https://nowhere.invalid/"},
+					{Match: `^https://upstream\.example\.com/files/(.*)$`, Replacement: server.URL + "/$1"},
+				},
+				Logger: libbuildpack.NewLogger(&out),
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(result.Dependencies[0].URI).To(Equal("https://upstream.example.com/files/dep-1"))
+			Expect(packager.CachePath(packager.Dependency{URI: "https://upstream.example.com/files/dep-1"}, cacheDir)).To(BeARegularFile())
+			Expect(out.String()).To(ContainSubstring("Downloading dep-1 1.0.0 from " + server.URL + "/dep-1"))
+			Expect(out.String()).To(ContainSubstring("(rewritten from https://upstream.example.com/files/dep-1)"))
+		})
+
+		It("still verifies the checksum", func() {
+			handler = func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "mirrored") }
+			_, err := packageWith(packager.PackageOptions{
+				URIRewrites: []packager.URIRewrite{{Match: `^https://upstream\.example\.com/files`, Replacement: server.URL}},
+			})
+			Expect(err).To(MatchError(ContainSubstring("dependency sha256 mismatch")))
+		})
+
+		It("rejects an invalid rule", func() {
+			_, err := packageWith(packager.PackageOptions{URIRewrites: []packager.URIRewrite{{Match: "("}}})
+			Expect(err).To(MatchError(HavePrefix(`Invalid URI rewrite "(":`)))
+		})
+	})
+
+	It("zips a dependency listed for several stacks once", func() {
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), []byte(fmt.Sprintf(`---
+language: ruby
+default_versions: []
+dependencies:
+- name: dep-1
+  version: 1.0.0
+  uri: %[1]s/dep-1
+  sha256: %[2]x
+  cf_stacks: [cflinuxfs3]
+- name: dep-1
+  version: 1.0.0
+  uri: %[1]s/dep-1
+  sha256: %[2]x
+  cf_stacks: [cflinuxfs4]
+`, server.URL, sha256.Sum256([]byte("/dep-1")))), 0644)).To(Succeed())
+
+		result, err := packager.Packager{Stdout: ioutil.Discard}.PackageToWriter(packager.PackageOptions{
+			BuildpackDir: bpDir,
+			CacheDir:     cacheDir,
+			Version:      "1.2.3",
+			Cached:       true,
+		}, ioutil.Discard)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Dependencies).To(HaveLen(2))
+		Expect(result.Files).To(HaveLen(1))
+	})
+
+	It("does not copy a cache kept inside the buildpack", func() {
+		cacheDir = filepath.Join(bpDir, ".cache")
+		writeBuildpack(2)
+		listing := filepath.Join(bpDir, "..", filepath.Base(bpDir)+".listing")
+		defer os.Remove(listing)
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "list.sh"), []byte("#!/bin/sh\nfind . > "+listing+"\n"), 0755)).To(Succeed())
+		manifest, err := ioutil.ReadFile(filepath.Join(bpDir, "manifest.yml"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), append(manifest, "pre_package: ./list.sh\n"...), 0644)).To(Succeed())
+
+		_, err = packageWith(packager.PackageOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = packageWith(packager.PackageOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(filepath.Join(cacheDir, "dependencies")).To(BeADirectory())
+		copied, err := ioutil.ReadFile(listing)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(copied)).To(ContainSubstring("./list.sh"))
+		Expect(string(copied)).NotTo(ContainSubstring(".cache"))
+	})
+
+	Context("with local dependencies", func() {
+		writeLocalManifest := func(uri, contents string) {
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), []byte(fmt.Sprintf(`---
+language: ruby
+default_versions: []
+dependencies:
+- name: local
+  version: 1.0.0
+  uri: %s
+  sha256: %x
+  cf_stacks: [cflinuxfs3]
+`, uri, sha256.Sum256([]byte(contents)))), 0644)).To(Succeed())
+		}
+
+		It("resolves relative paths against the buildpack directory", func() {
+			Expect(os.MkdirAll(filepath.Join(bpDir, "vendor"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, "vendor", "x.tgz"), []byte("relative"), 0644)).To(Succeed())
+			writeLocalManifest("file://./vendor/x.tgz", "relative")
+
+			result, err := packageWith(packager.PackageOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ZipContents(zipFile, result.Files[len(result.Files)-1])).To(Equal("relative"))
+		})
+
+		It("uses absolute paths as they are", func() {
+			localFile := filepath.Join(cacheDir, "..", filepath.Base(cacheDir)+".tgz")
+			Expect(ioutil.WriteFile(localFile, []byte("absolute"), 0644)).To(Succeed())
+			defer os.Remove(localFile)
+			writeLocalManifest("file://"+localFile, "absolute")
+
+			result, err := packageWith(packager.PackageOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ZipContents(zipFile, result.Files[len(result.Files)-1])).To(Equal("absolute"))
+		})
+	})
+
+	Context("skipping checksums of file:// dependencies", func() {
+		var localFile string
+
+		BeforeEach(func() {
+			localFile = filepath.Join(bpDir, "..", filepath.Base(bpDir)+".tgz")
+			Expect(ioutil.WriteFile(localFile, []byte("first"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), []byte(fmt.Sprintf(`---
+language: ruby
+default_versions: []
+dependencies:
+- name: local
+  version: 1.0.0
+  uri: file://%s
+  sha256: stale
+  cf_stacks: [cflinuxfs3]
+`, localFile)), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() { os.Remove(localFile) })
+
+		It("verifies them by default", func() {
+			_, err := packageWith(packager.PackageOptions{})
+			Expect(err).To(MatchError(ContainSubstring("dependency sha256 mismatch")))
+		})
+
+		It("packages the current contents with a warning when asked to", func() {
+			var out bytes.Buffer
+			_, err := packageWith(packager.PackageOptions{SkipFileChecksums: true, Logger: libbuildpack.NewLogger(&out)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(out.String()).To(ContainSubstring("Checksum verification of local 1.0.0 from file://" + localFile + " was skipped"))
+
+			Expect(ioutil.WriteFile(localFile, []byte("second"), 0644)).To(Succeed())
+			result, err := packageWith(packager.PackageOptions{SkipFileChecksums: true, Logger: libbuildpack.NewLogger(ioutil.Discard)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Dependencies[0].Download.CacheHit).To(BeFalse())
+			Expect(ZipContents(zipFile, result.Files[len(result.Files)-1])).To(Equal("second"))
+			Expect(filepath.Join(cacheDir, "sha256", "stale")).NotTo(BeAnExistingFile())
+		})
+
+		It("rebuilds an incremental zip when the file changes", func() {
+			options := packager.PackageOptions{SkipFileChecksums: true, Incremental: true, Logger: libbuildpack.NewLogger(ioutil.Discard)}
+			_, err := packageWith(options)
+			Expect(err).NotTo(HaveOccurred())
+			result, err := packageWith(options)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.UpToDate).To(BeTrue())
+
+			Expect(ioutil.WriteFile(localFile, []byte("changed contents"), 0644)).To(Succeed())
+			result, err = packageWith(options)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.UpToDate).To(BeFalse())
+			Expect(ZipContents(zipFile, result.Files[len(result.Files)-1])).To(Equal("changed contents"))
+		})
+
+		It("still verifies dependencies fetched over the network", func() {
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), []byte(fmt.Sprintf("---\nlanguage: ruby\ndefault_versions: []\ndependencies:\n- name: dep-1\n  version: 1.0.0\n  uri: %s/dep-1\n  sha256: stale\n  cf_stacks: [cflinuxfs3]\n", server.URL)), 0644)).To(Succeed())
+
+			_, err := packageWith(packager.PackageOptions{SkipFileChecksums: true})
+			Expect(err).To(MatchError(ContainSubstring("dependency sha256 mismatch")))
+		})
+	})
+
+	Context("with a dependency without a checksum", func() {
+		var requests int32
+
+		BeforeEach(func() {
+			requests = 0
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				fmt.Fprint(w, r.URL.Path)
+			}
+			writeBuildpack(1)
+			manifest, err := ioutil.ReadFile(filepath.Join(bpDir, "manifest.yml"))
+			Expect(err).NotTo(HaveOccurred())
+			manifest = regexp.MustCompile(`(?m)^  sha256: .*\n`).ReplaceAll(manifest, nil)
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), manifest, 0644)).To(Succeed())
+		})
+
+		It("fails before downloading anything", func() {
+			_, err := packageWith(packager.PackageOptions{})
+			Expect(err).To(MatchError(ContainSubstring("dependency #1 (dep-1 1.0.0) is missing a checksum")))
+			Expect(atomic.LoadInt32(&requests)).To(BeZero())
+		})
+
+		It("packages it unverified when unchecked dependencies are allowed", func() {
+			var out bytes.Buffer
+			_, err := packageWith(packager.PackageOptions{AllowUnchecked: true, Logger: libbuildpack.NewLogger(&out)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ZipContents(zipFile, "manifest.yml")).NotTo(ContainSubstring("sha256"))
+			Expect(out.String()).To(ContainSubstring("dep-1 1.0.0 has no checksum and was not verified"))
+		})
+	})
+
+	Context("with timeouts", func() {
+		BeforeEach(func() {
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/dep-2" {
+					time.Sleep(500 * time.Millisecond)
+				}
+				fmt.Fprint(w, r.URL.Path)
+			}
+			writeBuildpack(2)
+		})
+
+		It("fails a dependency that exceeds the default timeout", func() {
+			_, err := packageWith(packager.PackageOptions{DependencyTimeout: 100 * time.Millisecond})
+			Expect(err).To(MatchError(ContainSubstring("timed out downloading dep-2 1.0.0 from " + server.URL + "/dep-2 after 100ms")))
+		})
+
+		It("uses a dependency's own download_timeout", func() {
+			manifest, err := ioutil.ReadFile(filepath.Join(bpDir, "manifest.yml"))
+			Expect(err).NotTo(HaveOccurred())
+			manifest = []byte(strings.Replace(string(manifest), "/dep-2\n", "/dep-2\n  download_timeout: 2s\n", 1))
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), manifest, 0644)).To(Succeed())
+
+			_, err = packageWith(packager.PackageOptions{DependencyTimeout: 100 * time.Millisecond})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("does not leave a partial download in the cache", func() {
+			_, err := packageWith(packager.PackageOptions{DependencyTimeout: 100 * time.Millisecond})
+			Expect(err).To(HaveOccurred())
+
+			handler = func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, r.URL.Path) }
+			_, err = packageWith(packager.PackageOptions{DependencyTimeout: 100 * time.Millisecond})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("user agent", func() {
+		var userAgents []string
+		BeforeEach(func() {
+			userAgents = nil
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				userAgents = append(userAgents, r.UserAgent())
+				fmt.Fprint(w, r.URL.Path)
+			}
+			writeBuildpack(1)
+		})
+
+		It("identifies the packager by default", func() {
+			_, err := packageWith(packager.PackageOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userAgents).To(Equal([]string{packager.DefaultUserAgent}))
+			Expect(packager.DefaultUserAgent).To(HavePrefix("libbuildpack-packager"))
+		})
+
+		It("sends the configured user agent", func() {
+			_, err := packageWith(packager.PackageOptions{UserAgent: "my-mirror-client/1.0"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userAgents).To(Equal([]string{"my-mirror-client/1.0"}))
+		})
+	})
+
+	Context("with a .netrc file", func() {
+		var (
+			auth     []string
+			oldNetrc string
+		)
+		BeforeEach(func() {
+			auth = nil
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				user, password, _ := r.BasicAuth()
+				auth = append(auth, user+":"+password)
+				fmt.Fprint(w, r.URL.Path)
+			}
+			writeBuildpack(1)
+
+			netrc := filepath.Join(bpDir, "netrc")
+			Expect(ioutil.WriteFile(netrc, []byte("machine example.com login other password wrong\nmachine 127.0.0.1\n  login mirror\n  password s3cret\n"), 0600)).To(Succeed())
+			oldNetrc = os.Getenv("NETRC")
+			os.Setenv("NETRC", netrc)
+		})
+		AfterEach(func() { os.Setenv("NETRC", oldNetrc) })
+
+		It("sends the credentials for the host", func() {
+			_, err := packageWith(packager.PackageOptions{UseNetrc: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(auth).To(Equal([]string{"mirror:s3cret"}))
+		})
+
+		It("ignores the file unless asked to use it", func() {
+			_, err := packageWith(packager.PackageOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(auth).To(Equal([]string{":"}))
+		})
+	})
+
+	Context("caching", func() {
+		var requests int
+		BeforeEach(func() {
+			requests = 0
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				fmt.Fprint(w, r.URL.Path)
+			}
+			writeBuildpack(1)
+		})
+
+		It("stores downloads under the sha256 of the URI", func() {
+			_, err := packageWith(packager.PackageOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			key := fmt.Sprintf("%x", sha256.Sum256([]byte(server.URL+"/dep-1")))
+			Expect(filepath.Join(cacheDir, "dependencies", key, "dep-1")).To(BeAnExistingFile())
+
+			_, err = packageWith(packager.PackageOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(requests).To(Equal(1))
+		})
+
+		It("reports the size and duration of each download and cache hits", func() {
+			first, err := packageWith(packager.PackageOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(first.Dependencies[0].Download.CacheHit).To(BeFalse())
+			Expect(first.Dependencies[0].Download.Bytes).To(Equal(int64(len("/dep-1"))))
+			Expect(first.Dependencies[0].Download.Duration).To(BeNumerically(">", 0))
+
+			second, err := packageWith(packager.PackageOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(second.Dependencies[0].Download.CacheHit).To(BeTrue())
+			Expect(second.Dependencies[0].Download.Bytes).To(Equal(int64(len("/dep-1"))))
+		})
+
+		It("reuses downloaded content for dependencies with the same sha256", func() {
+			manifest, err := ioutil.ReadFile(filepath.Join(bpDir, "manifest.yml"))
+			Expect(err).NotTo(HaveOccurred())
+			manifest = append(manifest, []byte(fmt.Sprintf("- name: dep-1-mirror\n  version: 1.0.0\n  uri: %s/mirror/dep-1\n  sha256: %x\n  cf_stacks: [cflinuxfs3]\n",
+				server.URL, sha256.Sum256([]byte("/dep-1"))))...)
+			Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), manifest, 0644)).To(Succeed())
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				requests++
+				mutex.Unlock()
+				fmt.Fprint(w, strings.TrimPrefix(r.URL.Path, "/mirror"))
+			}
+
+			result, err := packageWith(packager.PackageOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(requests).To(Equal(1))
+			Expect(ZipContents(zipFile, result.Files[2])).To(Equal("/dep-1"))
+		})
+
+		Context("when a dependency is revalidated", func() {
+			var served int
+			BeforeEach(func() {
+				served = 0
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					requests++
+					if r.Header.Get("If-None-Match") == `"v1"` {
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+					served++
+					w.Header().Set("ETag", `"v1"`)
+					fmt.Fprint(w, r.URL.Path)
+				}
+
+				manifest, err := ioutil.ReadFile(filepath.Join(bpDir, "manifest.yml"))
+				Expect(err).NotTo(HaveOccurred())
+				manifest = []byte(strings.Replace(string(manifest), "/dep-1\n", "/dep-1\n  revalidate: true\n", 1))
+				Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), manifest, 0644)).To(Succeed())
+			})
+
+			It("reuses the cache when the server reports it is not modified", func() {
+				_, err := packageWith(packager.PackageOptions{})
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := packageWith(packager.PackageOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(requests).To(Equal(2))
+				Expect(served).To(Equal(1))
+				Expect(result.Dependencies[0].Download.CacheHit).To(BeTrue())
+				Expect(ZipContents(zipFile, result.Files[1])).To(Equal("/dep-1"))
+			})
+
+			It("downloads the dependency again when it has changed", func() {
+				_, err := packageWith(packager.PackageOptions{})
+				Expect(err).NotTo(HaveOccurred())
+
+				key := fmt.Sprintf("%x", sha256.Sum256([]byte(server.URL+"/dep-1")))
+				Expect(ioutil.WriteFile(filepath.Join(cacheDir, "dependencies", key, "dep-1.validators"), []byte(`{"etag":"\"v0\""}`), 0644)).To(Succeed())
+
+				result, err := packageWith(packager.PackageOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(served).To(Equal(2))
+				Expect(result.Dependencies[0].Download.CacheHit).To(BeFalse())
+			})
+		})
+
+		It("downloads a cached dependency again when it no longer matches its recorded sha256", func() {
+			_, err := packageWith(packager.PackageOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			key := fmt.Sprintf("%x", sha256.Sum256([]byte(server.URL+"/dep-1")))
+			cached := filepath.Join(cacheDir, "dependencies", key, "dep-1")
+			Expect(ioutil.ReadFile(cached + ".sha256")).To(Equal([]byte(fmt.Sprintf("%x\n", sha256.Sum256([]byte("/dep-1"))))))
+			Expect(os.Remove(cached)).To(Succeed())
+			Expect(ioutil.WriteFile(cached, []byte("/dep-X"), 0644)).To(Succeed())
+
+			result, err := packageWith(packager.PackageOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(requests).To(Equal(2))
+			Expect(result.Dependencies[0].Download.CacheHit).To(BeFalse())
+			Expect(ZipContents(zipFile, result.Files[1])).To(Equal("/dep-1"))
+		})
+
+		It("does not hash a cached dependency again once it matches its recorded sha256", func() {
+			_, err := packageWith(packager.PackageOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			buffer := new(bytes.Buffer)
+			_, err = packageWith(packager.PackageOptions{Logger: libbuildpack.NewLogger(buffer), Verbose: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buffer.String()).To(ContainSubstring("dep-1 1.0.0: cached copy matches its recorded sha256"))
+		})
+
+		It("records no sha256 next to files downloaded with DownloadFromURI", func() {
+			fileName := filepath.Join(cacheDir, "downloaded")
+			Expect(packager.DownloadFromURI(server.URL+"/dep-1", fileName)).To(Succeed())
+			Expect(ioutil.ReadFile(fileName)).To(Equal([]byte("/dep-1")))
+			Expect(fileName + ".sha256").NotTo(BeAnExistingFile())
+		})
+
+		Context("with an entry cached without a recorded sha256", func() {
+			var cached string
+			BeforeEach(func() {
+				_, err := packageWith(packager.PackageOptions{})
+				Expect(err).NotTo(HaveOccurred())
+
+				key := fmt.Sprintf("%x", sha256.Sum256([]byte(server.URL+"/dep-1")))
+				cached = filepath.Join(cacheDir, "dependencies", key, "dep-1")
+				Expect(os.Remove(cached + ".sha256")).To(Succeed())
+			})
+
+			It("reuses it when it matches the manifest", func() {
+				_, err := packageWith(packager.PackageOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(requests).To(Equal(1))
+			})
+
+			It("downloads it once more when it does not match the manifest", func() {
+				Expect(os.Remove(cached)).To(Succeed())
+				Expect(ioutil.WriteFile(cached, []byte("/dep-X"), 0644)).To(Succeed())
+
+				result, err := packageWith(packager.PackageOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(requests).To(Equal(2))
+				Expect(result.Dependencies[0].Download.CacheHit).To(BeFalse())
+				Expect(ZipContents(zipFile, result.Files[1])).To(Equal("/dep-1"))
+			})
+
+			It("fails when the fresh download does not match either", func() {
+				Expect(os.Remove(cached)).To(Succeed())
+				Expect(ioutil.WriteFile(cached, []byte("/dep-X"), 0644)).To(Succeed())
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					requests++
+					fmt.Fprint(w, "/dep-Y")
+				}
+
+				_, err := packageWith(packager.PackageOptions{})
+				Expect(err).To(MatchError(ContainSubstring("dependency sha256 mismatch")))
+				Expect(requests).To(Equal(2))
+			})
+		})
+
+		It("reuses entries cached under the md5 of the URI", func() {
+			key := fmt.Sprintf("%x", md5.Sum([]byte(server.URL+"/dep-1")))
+			Expect(os.MkdirAll(filepath.Join(cacheDir, "dependencies", key), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(cacheDir, "dependencies", key, "dep-1"), []byte("/dep-1"), 0644)).To(Succeed())
+
+			result, err := packageWith(packager.PackageOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(requests).To(Equal(0))
+			Expect(ZipContents(zipFile, result.Files[1])).To(Equal("/dep-1"))
+		})
+	})
+})
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// eventRecorder passes on each event written to it.
+type eventRecorder chan packager.Event
+
+func (r eventRecorder) Write(b []byte) (int, error) {
+	var event packager.Event
+	if err := json.Unmarshal(b, &event); err != nil {
+		return 0, err
+	}
+	r <- event
+	return len(b), nil
+}
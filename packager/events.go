@@ -0,0 +1,41 @@
+package packager
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// Event is a machine-readable record of packaging progress. Events are
+// written to PackageOptions.Events as one JSON object per line.
+type Event struct {
+	Event  string `json:"event"`
+	Dep    string `json:"dep,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+	File   string `json:"file,omitempty"`
+	Zip    string `json:"zip,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type eventEmitter struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func newEventEmitter(w io.Writer) *eventEmitter {
+	if w == nil {
+		return nil
+	}
+	return &eventEmitter{encoder: json.NewEncoder(w)}
+}
+
+// emit is a no-op on a nil emitter, so callers need not check whether
+// events are enabled.
+func (e *eventEmitter) emit(event Event) {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.encoder.Encode(event)
+}
@@ -0,0 +1,118 @@
+package packager
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// PackageFromGit packages the buildpack at ref of the git repository at
+// repoURL. See Packager.PackageFromGit.
+func PackageFromGit(repoURL, ref string, options PackageOptions) (Result, error) {
+	return defaultPackager().PackageFromGit(repoURL, ref, options)
+}
+
+// PackageFromGit packages a shallow clone of ref of repoURL, or of its
+// default branch when ref is empty, and records the commit in
+// Result.GitCommit. options.BuildpackDir is used as the output directory.
+func (p Packager) PackageFromGit(repoURL, ref string, options PackageOptions) (Result, error) {
+	outDir := options.BuildpackDir
+	if outDir == "" {
+		outDir = "."
+	}
+	outDir, err := filepath.Abs(outDir)
+	if err != nil {
+		return Result{}, err
+	}
+
+	dir, err := ioutil.TempDir(options.TempDir, "buildpack-git")
+	if err != nil {
+		return Result{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	commit, err := cloneGit(repoURL, ref, dir)
+	if err != nil {
+		return Result{}, err
+	}
+
+	options.BuildpackDir = dir
+	options.Incremental = false
+	result, err := p.PackageWithOptions(options)
+	if err != nil {
+		return Result{}, err
+	}
+	result.GitCommit = commit
+
+	if result.ZipFile, err = moveFile(result.ZipFile, outDir); err != nil {
+		return Result{}, err
+	}
+	if result.SignatureFile != "" {
+		if result.SignatureFile, err = moveFile(result.SignatureFile, outDir); err != nil {
+			return Result{}, err
+		}
+	}
+	if result.ReleaseSummaryFile != "" {
+		if result.ReleaseSummaryFile, err = moveFile(result.ReleaseSummaryFile, outDir); err != nil {
+			return Result{}, err
+		}
+	}
+	return result, nil
+}
+
+// cloneGit fetches ref of repoURL into dir without any history and returns
+// the sha of the commit checked out.
+func cloneGit(repoURL, ref, dir string) (string, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	steps := [][]string{
+		{"init", "--quiet"},
+		{"fetch", "--quiet", "--depth", "1", repoURL, ref},
+		{"checkout", "--quiet", "--detach", "FETCH_HEAD"},
+	}
+	for _, args := range steps {
+		if _, err := runGit(dir, args...); err != nil {
+			return "", fmt.Errorf("Failed to clone %s at %s: %v", repoURL, ref, err)
+		}
+	}
+
+	commit, err := runGit(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("Failed to resolve %s at %s: %v", repoURL, ref, err)
+	}
+	return commit, nil
+}
+
+func runGit(dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	// Fail rather than wait for credentials nobody will type.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %v\n%s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// moveFile moves path into dir, copying it when a rename is not possible,
+// and returns its new path.
+func moveFile(path, dir string) (string, error) {
+	dest := filepath.Join(dir, filepath.Base(path))
+	if err := os.Rename(path, dest); err == nil {
+		return dest, nil
+	}
+	if err := libbuildpack.CopyFile(path, dest); err != nil {
+		return "", fmt.Errorf("Failed to copy %s to %s: %v", path, dir, err)
+	}
+	return dest, nil
+}
@@ -0,0 +1,96 @@
+package packager_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/libbuildpack/packager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PackageFromGit", func() {
+	var (
+		repoDir, outDir string
+		commit          string
+	)
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repoDir
+		out, err := cmd.CombinedOutput()
+		Expect(err).NotTo(HaveOccurred(), string(out))
+		return strings.TrimSpace(string(out))
+	}
+
+	BeforeEach(func() {
+		if _, err := exec.LookPath("git"); err != nil {
+			Skip("git is not installed")
+		}
+
+		var err error
+		repoDir, err = ioutil.TempDir("", "packager-git-repo")
+		Expect(err).NotTo(HaveOccurred())
+		outDir, err = ioutil.TempDir("", "packager-git-out")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(libbuildpack.CopyDirectory("./fixtures/good", repoDir)).To(Succeed())
+		git("init", "--quiet")
+		git("add", ".")
+		git("commit", "--quiet", "-m", "first")
+		git("tag", "v1")
+		commit = git("rev-parse", "HEAD")
+
+		Expect(ioutil.WriteFile(filepath.Join(repoDir, "VERSION"), []byte("2.0.0"), 0644)).To(Succeed())
+		git("commit", "--quiet", "-am", "second")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(repoDir)
+		os.RemoveAll(outDir)
+	})
+
+	It("packages the ref and moves the zip out of the clone", func() {
+		result, err := packager.Packager{Stdout: ioutil.Discard}.PackageFromGit("file://"+repoDir, "v1", packager.PackageOptions{
+			BuildpackDir: outDir,
+			Stack:        "cflinuxfs2",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(result.GitCommit).To(Equal(commit))
+		Expect(result.ZipFile).To(Equal(filepath.Join(outDir, "ruby_buildpack-cflinuxfs2-v1.45.8.zip")))
+		Expect(result.ZipFile).To(BeARegularFile())
+	})
+
+	It("moves the release summary out of the clone", func() {
+		result, err := packager.Packager{Stdout: ioutil.Discard}.PackageFromGit("file://"+repoDir, "v1", packager.PackageOptions{
+			BuildpackDir:   outDir,
+			Stack:          "cflinuxfs2",
+			ReleaseSummary: true,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(result.ReleaseSummaryFile).To(Equal(filepath.Join(outDir, "ruby_buildpack-cflinuxfs2-v1.45.8.zip.json")))
+		Expect(result.ReleaseSummaryFile).To(BeARegularFile())
+	})
+
+	It("packages the default branch when no ref is given", func() {
+		result, err := packager.Packager{Stdout: ioutil.Discard}.PackageFromGit("file://"+repoDir, "", packager.PackageOptions{
+			BuildpackDir: outDir,
+			Stack:        "cflinuxfs2",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.GitCommit).NotTo(Equal(commit))
+		Expect(result.ZipFile).To(Equal(filepath.Join(outDir, "ruby_buildpack-cflinuxfs2-v2.0.0.zip")))
+	})
+
+	It("reports a ref that does not exist", func() {
+		_, err := packager.Packager{Stdout: ioutil.Discard}.PackageFromGit("file://"+repoDir, "missing", packager.PackageOptions{BuildpackDir: outDir})
+		Expect(err).To(MatchError(HavePrefix("Failed to clone file://" + repoDir + " at missing: git fetch:")))
+	})
+})
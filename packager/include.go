@@ -0,0 +1,95 @@
+package packager
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// expandIncludeFiles resolves glob patterns in include_files against dir.
+// Patterns use the same syntax as .buildpackignore and only match files.
+// A directory stands for itself and everything beneath it, though a
+// symlink to a directory is not followed. Other literal entries, and
+// patterns that match nothing, are passed through unchanged so that
+// missing entries can be reported. The result contains each name once, in
+// manifest order.
+func expandIncludeFiles(dir string, includeFiles []string) ([]string, error) {
+	var names []string
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for _, entry := range includeFiles {
+		if !strings.ContainsAny(entry, "*?[") {
+			if info, err := os.Lstat(filepath.Join(dir, entry)); err == nil && info.IsDir() {
+				names, err := walkIncludeDir(dir, entry)
+				if err != nil {
+					return nil, err
+				}
+				for _, name := range names {
+					add(name)
+				}
+				continue
+			}
+			add(entry)
+			continue
+		}
+
+		pattern, err := regexp.Compile("^" + globToRegexp(strings.TrimPrefix(filepath.ToSlash(entry), "/")) + "$")
+		if err != nil {
+			return nil, err
+		}
+
+		var matches []string
+		err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			if pattern.MatchString(filepath.ToSlash(rel)) {
+				matches = append(matches, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(matches) == 0 {
+			add(entry)
+		}
+		for _, match := range matches {
+			add(match)
+		}
+	}
+	return names, nil
+}
+
+// walkIncludeDir lists the directory entry of dir and everything beneath
+// it, relative to dir.
+func walkIncludeDir(dir, entry string) ([]string, error) {
+	var names []string
+	err := filepath.Walk(filepath.Join(dir, entry), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	return names, err
+}
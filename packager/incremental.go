@@ -0,0 +1,194 @@
+package packager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// inputsPath is where the hash of the inputs a zip was built from is stored.
+func inputsPath(zipFile string) string {
+	return zipFile + ".inputs"
+}
+
+// inputsHash hashes what a buildpack packaged from bpDir would be built
+// from: the packaging options which change the zip, the manifest.yml in
+// manifestDir, the include_files and pre_package script present in bpDir
+// along with their modes, the dependencies for the stack, the extra
+// dependencies and any extra files.
+//
+// A compressor or manifest transform is a function, so only whether one is
+// set can be recorded. With SkipFileChecksums, file:// dependencies are not
+// pinned by their checksums, so their sizes and modification times are
+// hashed as well.
+func inputsHash(bpDir, manifestDir string, manifest Manifest, options PackageOptions, version, stack string, cached bool, extras []ExtraFile) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "version=%s\x00stack=%s\x00cached=%t\x00", version, stack, cached)
+	fmt.Fprintf(hash, "normalizeModes=%t\x00zipComment=%t\x00compressor=%t\x00transformManifest=%t\x00",
+		options.NormalizeModes, options.ZipComment, options.Compressor != nil, options.TransformManifest != nil)
+	fmt.Fprint(hash, "manifest\x00")
+	if err := hashFile(hash, filepath.Join(manifestDir, "manifest.yml")); err != nil {
+		return "", err
+	}
+
+	names, err := expandIncludeFiles(bpDir, manifest.IncludeFiles)
+	if err != nil {
+		return "", err
+	}
+	if manifest.PrePackage != "" {
+		names = append(names, manifest.PrePackage)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(bpDir, name)
+		if !withinDir(bpDir, path) {
+			continue
+		}
+		fmt.Fprintf(hash, "file=%s\x00", filepath.ToSlash(filepath.Clean(name)))
+		if err := hashFile(hash, path); err != nil {
+			return "", err
+		}
+	}
+
+	for _, dep := range manifest.Dependencies {
+		if forStack(dep, stack) {
+			fmt.Fprintf(hash, "dependency=%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00", dep.Name, dep.Version, dep.URI, dep.SHA1, dep.SHA256, dep.SHA512)
+			if options.SkipFileChecksums {
+				hashFileDependency(hash, bpDir, dep)
+			}
+		}
+	}
+	for _, dep := range options.ExtraDependencies {
+		fmt.Fprintf(hash, "extraDependency=%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00", dep.Name, dep.Version, dep.URI, dep.SHA1, dep.SHA256, dep.SHA512)
+		if options.SkipFileChecksums {
+			hashFileDependency(hash, bpDir, dep)
+		}
+	}
+	for _, extra := range extras {
+		fmt.Fprintf(hash, "extra=%s\x00%o\x00%d\x00", extra.Name, extra.Mode, len(extra.Contents))
+		hash.Write(extra.Contents)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashFileDependency writes the size and modification time of the file a
+// file:// dependency refers to, if it exists, to w.
+func hashFileDependency(w io.Writer, bpDir string, dep Dependency) {
+	u, err := url.Parse(dep.URI)
+	if err != nil || u.Scheme != "file" {
+		return
+	}
+	d := downloader{bpDir: bpDir}
+	if info, err := os.Stat(d.filePath(u)); err == nil {
+		fmt.Fprintf(w, "file=%d\x00%d\x00", info.Size(), info.ModTime().UnixNano())
+	}
+}
+
+// hashFile writes the mode and contents of path to w. Missing files, such as
+// those generated by pre_package, and directories contribute nothing.
+func hashFile(w io.Writer, path string) error {
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	info, err := fh.Stat()
+	if err != nil {
+		return err
+	} else if info.IsDir() {
+		return nil
+	}
+	fmt.Fprintf(w, "mode=%o\x00", info.Mode())
+	_, err = io.Copy(w, fh)
+	return err
+}
+
+// upToDate reports whether zipFile exists and was built from inputs and,
+// when signed is set, has a signature.
+func upToDate(zipFile, inputs string, signed bool) bool {
+	if _, err := os.Stat(zipFile); err != nil {
+		return false
+	}
+	if _, err := os.Stat(zipFile + ".asc"); signed && err != nil {
+		return false
+	}
+	stored, err := ioutil.ReadFile(inputsPath(zipFile))
+	return err == nil && strings.TrimSpace(string(stored)) == inputs
+}
+
+// existingResult describes a zip left in place because it was up to date.
+func existingResult(zipFile string, manifest Manifest, extraDeps []Dependency, stack string, cached, releaseSummary bool) (Result, error) {
+	result := Result{ZipFile: zipFile, UpToDate: true, Stacks: packagedStacks(manifest, stack)}
+
+	stat, err := os.Stat(zipFile)
+	if err != nil {
+		return Result{}, err
+	}
+	result.Size = stat.Size()
+	if result.SHA256, err = sha256File(zipFile); err != nil {
+		return Result{}, err
+	}
+
+	entries, err := ListZipContents(zipFile)
+	if err != nil {
+		return Result{}, err
+	}
+	for _, entry := range entries {
+		result.Files = append(result.Files, entry.Name)
+	}
+
+	if _, err := os.Stat(zipFile + ".asc"); err == nil {
+		result.SignatureFile = zipFile + ".asc"
+	}
+	if releaseSummary {
+		result.ReleaseSummaryFile = releaseSummaryPath(zipFile)
+	}
+
+	for _, dep := range manifest.Dependencies {
+		if forStack(dep, stack) {
+			result.Dependencies = append(result.Dependencies, ResolvedDependency{Name: dep.Name, Version: dep.Version, URI: dep.URI, SHA256: dep.SHA256, Included: cached})
+		}
+	}
+	for _, dep := range extraDeps {
+		result.Dependencies = append(result.Dependencies, ResolvedDependency{Name: dep.Name, Version: dep.Version, URI: dep.URI, SHA256: dep.SHA256, Included: true})
+	}
+	return result, nil
+}
+
+// packagedStacks lists the stacks a buildpack packaged from manifest for
+// stack covers: stack itself or, for any stack, every stack the packaged
+// dependencies are built for, in manifest order.
+func packagedStacks(manifest Manifest, stack string) []string {
+	if stack != "" {
+		return []string{stack}
+	}
+	var packaged Manifest
+	for _, dep := range manifest.Dependencies {
+		if forStack(dep, stack) {
+			packaged.Dependencies = append(packaged.Dependencies, dep)
+		}
+	}
+	return packaged.stacks()
+}
+
+// forStack reports whether dep is packaged for stack, where the empty stack
+// means any stack.
+func forStack(dep Dependency, stack string) bool {
+	for _, s := range dep.Stacks {
+		if stack == "" || s == stack {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package packager
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+type LintOptions struct {
+	// CheckURIs sends a HEAD request for every dependency URI, reporting
+	// the unreachable ones as errors. file:// URIs are not checked.
+	CheckURIs bool
+
+	// UserAgent and UseNetrc are used for the URI checks as they are when
+	// packaging.
+	UserAgent string
+	UseNetrc  bool
+}
+
+// LintManifest runs every check made on the manifest.yml in bpDir while
+// packaging, without packaging it. See LintManifestWithOptions.
+func LintManifest(bpDir string) (warnings []string, errors []string, err error) {
+	return LintManifestWithOptions(context.Background(), bpDir, LintOptions{})
+}
+
+// LintManifestWithOptions reports the problems that would make packaging
+// the buildpack in bpDir fail as errors, and those that would not as
+// warnings:
+//
+//   - structural problems found by ValidateManifest, such as missing
+//     checksums and duplicate dependencies, are errors
+//   - default versions that do not resolve on one of the manifest's stacks
+//     are errors
+//   - include_files missing from bpDir are errors, or warnings when the
+//     manifest has a pre_package command which may create them
+//   - dependencies no default version selects are warnings
+//   - without a top-level stacks list, a dependency stack which nothing
+//     else in the manifest lists is a warning, since it may be a typo
+//   - a VERSION file that is missing, empty or not a semantic version is a
+//     warning
+//   - with CheckURIs, unreachable dependency URIs are errors
+//
+// err is only set when the checks could not be run, such as when
+// manifest.yml cannot be read.
+func LintManifestWithOptions(ctx context.Context, bpDir string, options LintOptions) (warnings []string, errors []string, err error) {
+	if err := ValidateManifest(bpDir); err != nil {
+		manifestErr, ok := err.(ManifestError)
+		if !ok {
+			return nil, nil, err
+		}
+		errors = append(errors, manifestErr.Problems...)
+	}
+
+	manifest, err := readManifest(bpDir)
+	if err != nil {
+		// ValidateManifest has already described why the manifest cannot
+		// be read as one.
+		return warnings, errors, nil
+	}
+
+	if err := ValidateDefaultVersions(bpDir); err != nil {
+		if manifestErr, ok := err.(ManifestError); ok {
+			errors = append(errors, manifestErr.Problems...)
+		} else {
+			return nil, nil, err
+		}
+	}
+
+	includeFiles, err := expandIncludeFiles(bpDir, manifest.IncludeFiles)
+	if err != nil {
+		errors = append(errors, fmt.Sprintf("invalid include_files: %v", err))
+	}
+	for _, name := range includeFiles {
+		if _, err := os.Stat(filepath.Join(bpDir, name)); err == nil {
+			continue
+		}
+		if manifest.PrePackage != "" {
+			warnings = append(warnings, fmt.Sprintf("include_files entry %s is not in the buildpack, unless pre_package creates it", name))
+		} else {
+			errors = append(errors, fmt.Sprintf("include_files entry %s is not in the buildpack", name))
+		}
+	}
+
+	unreferenced, err := UnreferencedDependencies(bpDir, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, dep := range unreferenced {
+		warnings = append(warnings, fmt.Sprintf("Dependency %s %s (%s) is not selected by any default version", dep.Name, dep.Version, dep.URI))
+	}
+	warnings = append(warnings, strayStackWarnings(manifest)...)
+
+	if data, err := ioutil.ReadFile(filepath.Join(bpDir, "VERSION")); os.IsNotExist(err) {
+		warnings = append(warnings, "There is no VERSION file, so packaging needs a version to be given")
+	} else if err != nil {
+		warnings = append(warnings, fmt.Sprintf("Could not read the VERSION file: %v", err))
+	} else if version := strings.TrimSpace(string(data)); version == "" {
+		warnings = append(warnings, "The VERSION file is empty, so packaging needs a version to be given")
+	} else if _, err := semver.Parse(version); err != nil {
+		warnings = append(warnings, fmt.Sprintf("Version `%s` is not a semantic version: %v", version, err))
+	}
+
+	if options.CheckURIs {
+		d, err := newDownloader(PackageOptions{UserAgent: options.UserAgent, UseNetrc: options.UseNetrc}, "", libbuildpack.NewLogger(ioutil.Discard))
+		if err != nil {
+			return nil, nil, err
+		}
+		defer d.close()
+		unreachable, err := d.unreachableURIs(ctx, "", bpDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, problem := range unreachable {
+			errors = append(errors, "Unreachable dependency URI: "+problem)
+		}
+	}
+
+	return warnings, errors, nil
+}
@@ -0,0 +1,164 @@
+package packager_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack/packager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LintManifest", func() {
+	var bpDir string
+
+	BeforeEach(func() {
+		var err error
+		bpDir, err = ioutil.TempDir("", "packager-lint")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "VERSION"), []byte("1.2.3\n"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "README.md"), []byte("readme"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() { os.RemoveAll(bpDir) })
+
+	writeManifest := func(contents string) {
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), []byte(contents), 0644)).To(Succeed())
+	}
+
+	It("reports no errors for a good buildpack", func() {
+		warnings, errors, err := packager.LintManifest("./fixtures/good")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(errors).To(BeEmpty())
+		Expect(warnings).To(Equal([]string{"include_files entry hi.txt is not in the buildpack, unless pre_package creates it"}))
+	})
+
+	It("separates warnings from errors", func() {
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "VERSION"), []byte("20200101\n"), 0644)).To(Succeed())
+		writeManifest(`---
+language: ruby
+include_files: [README.md, missing.txt]
+default_versions:
+- name: ruby
+  version: 1.2.x
+- name: node
+  version: 4.x
+dependencies:
+- name: ruby
+  version: 1.2.3
+  uri: https://example.com/ruby.tgz
+  cf_stacks: [cflinuxfs3]
+- name: ruby
+  version: 1.1.0
+  sha256: abc
+  uri: https://example.com/ruby-old.tgz
+  cf_stacks: [cflinuxfs3]
+`)
+
+		warnings, errors, err := packager.LintManifest(bpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(errors).To(Equal([]string{
+			"dependency #1 (ruby 1.2.3) is missing a checksum",
+			"No matching default dependency `node` for stack `cflinuxfs3`",
+			"include_files entry missing.txt is not in the buildpack",
+		}))
+		Expect(warnings).To(Equal([]string{
+			"Dependency ruby 1.1.0 (https://example.com/ruby-old.tgz) is not selected by any default version",
+			"Version `20200101` is not a semantic version: No Major.Minor.Patch elements found",
+		}))
+	})
+
+	It("warns about a dependency stack nothing else lists", func() {
+		manifest := `---
+language: ruby
+default_versions:
+- name: ruby
+  version: 1.2.x
+dependencies:
+- name: ruby
+  version: 1.2.3
+  sha256: abc
+  uri: https://example.com/ruby.tgz
+  cf_stacks: [cflinuxfs3]
+- name: ruby
+  version: 1.2.4
+  sha256: def
+  uri: https://example.com/ruby-new.tgz
+  cf_stacks: [cflinuxfs3, cflinuxf4]
+`
+		writeManifest(manifest)
+
+		warnings, errors, err := packager.LintManifest(bpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(errors).To(BeEmpty())
+		Expect(warnings).To(ContainElement("Dependency ruby 1.2.4 lists stack cflinuxf4, which nothing else in the manifest does"))
+
+		writeManifest(strings.Replace(manifest, "language: ruby\n", "language: ruby\nstacks: [cflinuxfs3, cflinuxf4]\n", 1))
+		warnings, _, err = packager.LintManifest(bpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).NotTo(ContainElement(ContainSubstring("nothing else in the manifest")))
+	})
+
+	It("warns about a missing or empty VERSION file", func() {
+		writeManifest("---\nlanguage: ruby\ndependencies: []\n")
+		Expect(os.Remove(filepath.Join(bpDir, "VERSION"))).To(Succeed())
+
+		warnings, errors, err := packager.LintManifest(bpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(errors).To(BeEmpty())
+		Expect(warnings).To(Equal([]string{"There is no VERSION file, so packaging needs a version to be given"}))
+
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "VERSION"), []byte("\n"), 0644)).To(Succeed())
+		warnings, _, err = packager.LintManifest(bpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(Equal([]string{"The VERSION file is empty, so packaging needs a version to be given"}))
+	})
+
+	It("only warns about missing include files when pre_package may create them", func() {
+		writeManifest("---\nlanguage: ruby\ninclude_files: [build/out]\npre_package: ./build.sh\ndependencies: []\n")
+
+		warnings, errors, err := packager.LintManifest(bpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(errors).To(BeEmpty())
+		Expect(warnings).To(Equal([]string{"include_files entry build/out is not in the buildpack, unless pre_package creates it"}))
+	})
+
+	It("reports a manifest that cannot be parsed as an error", func() {
+		writeManifest("language: [ruby\n")
+
+		_, errors, err := packager.LintManifest(bpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(errors).To(HaveLen(1))
+		Expect(errors[0]).To(HavePrefix("could not parse manifest.yml:"))
+	})
+
+	It("returns an error when there is no manifest", func() {
+		_, _, err := packager.LintManifest(bpDir)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reports unreachable URIs when asked to", func() {
+		server := httptest.NewServer(http.NotFoundHandler())
+		defer server.Close()
+		writeManifest(`---
+language: ruby
+default_versions: []
+dependencies:
+- name: ruby
+  version: 1.2.3
+  sha256: abc
+  uri: ` + server.URL + `/ruby.tgz
+  cf_stacks: [cflinuxfs3]
+`)
+
+		_, errors, err := packager.LintManifestWithOptions(context.Background(), bpDir, packager.LintOptions{CheckURIs: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(errors).To(ConsistOf(ContainSubstring("Unreachable dependency URI: ruby 1.2.3: " + server.URL + "/ruby.tgz")))
+	})
+})
@@ -1,30 +1,47 @@
 package packager
 
-import "github.com/Masterminds/semver"
+import (
+	"fmt"
+	"time"
+
+	"github.com/Masterminds/semver"
+)
 
 type Dependency struct {
 	URI             string          `yaml:"uri"`
 	File            string          `yaml:"file"`
+	SHA1            string          `yaml:"sha1"`
 	SHA256          string          `yaml:"sha256"`
+	SHA512          string          `yaml:"sha512"`
 	Name            string          `yaml:"name"`
 	Version         string          `yaml:"version"`
 	Stacks          []string        `yaml:"cf_stacks"`
 	SubDependencies []SubDependency `yaml:"dependencies"`
+	DownloadTimeout string          `yaml:"download_timeout"`
+	Revalidate      bool            `yaml:"revalidate"`
 }
 
 type SubDependency struct{ Name string }
 type Dependencies []Dependency
 
 type Manifest struct {
-	Language     string       `yaml:"language"`
-	Stack        string       `yaml:"stack"`
-	IncludeFiles []string     `yaml:"include_files"`
-	PrePackage   string       `yaml:"pre_package"`
-	Dependencies Dependencies `yaml:"dependencies"`
-	Defaults     []struct {
-		Name    string `yaml:"name"`
-		Version string `yaml:"version"`
-	} `yaml:"default_versions"`
+	Language       string           `yaml:"language"`
+	Stack          string           `yaml:"stack"`
+	DeclaredStacks []string         `yaml:"stacks"`
+	IncludeFiles   []string         `yaml:"include_files"`
+	PrePackage     string           `yaml:"pre_package"`
+	PrePackageArgs []string         `yaml:"pre_package_args"`
+	Dependencies   Dependencies     `yaml:"dependencies"`
+	Defaults       []DefaultVersion `yaml:"default_versions"`
+}
+
+// DefaultVersion is an entry of default_versions. One with cf_stacks only
+// applies on those stacks, and takes the place there of any entry of the
+// same name without cf_stacks.
+type DefaultVersion struct {
+	Name    string   `yaml:"name"`
+	Version string   `yaml:"version"`
+	Stacks  []string `yaml:"cf_stacks"`
 }
 
 type File struct {
@@ -59,6 +76,41 @@ func (m Manifest) hasStack(stack string) bool {
 	return false
 }
 
+// stacks lists the stacks of the manifest's dependencies in the order they
+// first appear.
+func (m Manifest) stacks() []string {
+	var stacks []string
+	seen := map[string]bool{}
+	for _, e := range m.Dependencies {
+		for _, s := range e.Stacks {
+			if !seen[s] {
+				seen[s] = true
+				stacks = append(stacks, s)
+			}
+		}
+	}
+	return stacks
+}
+
+// stackDefaults lists the indexes of the default versions which apply on
+// stack, in manifest order.
+func (m Manifest) stackDefaults(stack string) []int {
+	scoped := map[string]bool{}
+	for _, d := range m.Defaults {
+		if containsString(d.Stacks, stack) {
+			scoped[d.Name] = true
+		}
+	}
+
+	var indexes []int
+	for i, d := range m.Defaults {
+		if containsString(d.Stacks, stack) || (len(d.Stacks) == 0 && !scoped[d.Name]) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
 func (m Manifest) versionsOfDependencyWithStack(depName, stack string) []string {
 	versions := []string{}
 	for _, e := range m.Dependencies {
@@ -72,3 +124,20 @@ func (m Manifest) versionsOfDependencyWithStack(depName, stack string) []string
 	}
 	return versions
 }
+
+func (d Dependency) hasChecksum() bool {
+	return d.SHA1 != "" || d.SHA256 != "" || d.SHA512 != ""
+}
+
+// downloadTimeout returns the dependency's download_timeout, or fallback
+// when it has none.
+func (d Dependency) downloadTimeout(fallback time.Duration) (time.Duration, error) {
+	if d.DownloadTimeout == "" {
+		return fallback, nil
+	}
+	timeout, err := time.ParseDuration(d.DownloadTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid download_timeout %q for dependency %s %s: %v", d.DownloadTimeout, d.Name, d.Version, err)
+	}
+	return timeout, nil
+}
@@ -0,0 +1,98 @@
+package packager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// netrcMachine holds the credentials of one machine (or the default) entry
+// of a .netrc file.
+type netrcMachine struct {
+	name     string
+	login    string
+	password string
+}
+
+type netrcMachines []netrcMachine
+
+// netrcPath is the file named by $NETRC, or ~/.netrc.
+func netrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// readNetrc parses the .netrc file at path. A missing file yields no
+// machines. Errors never include the file's contents so that passwords are
+// not leaked into logs.
+func readNetrc(path string) (netrcMachines, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", path, err)
+	}
+
+	var machines netrcMachines
+	tokens := strings.Fields(string(data))
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "machine":
+			if i+1 >= len(tokens) {
+				return nil, fmt.Errorf("Failed to parse %s: machine without a name", path)
+			}
+			i++
+			machines = append(machines, netrcMachine{name: tokens[i]})
+		case "default":
+			machines = append(machines, netrcMachine{})
+		case "login", "password", "account":
+			if i+1 >= len(tokens) {
+				return nil, fmt.Errorf("Failed to parse %s: %s without a value", path, tokens[i])
+			}
+			if len(machines) == 0 {
+				return nil, fmt.Errorf("Failed to parse %s: %s outside of a machine", path, tokens[i])
+			}
+			m := &machines[len(machines)-1]
+			if tokens[i] == "login" {
+				m.login = tokens[i+1]
+			} else if tokens[i] == "password" {
+				m.password = tokens[i+1]
+			}
+			i++
+		case "macdef":
+			// Macros run until the next blank line, which Fields has already
+			// discarded, so skip to the next entry.
+			for i+1 < len(tokens) && tokens[i+1] != "machine" && tokens[i+1] != "default" {
+				i++
+			}
+		}
+	}
+	return machines, nil
+}
+
+// lookup returns the credentials for host, falling back to the default
+// entry. As with other netrc readers the first matching entry wins.
+func (n netrcMachines) lookup(host string) (string, string, bool) {
+	for _, m := range n {
+		if m.name == host {
+			return m.login, m.password, true
+		}
+	}
+	for _, m := range n {
+		if m.name == "" {
+			return m.login, m.password, true
+		}
+	}
+	return "", "", false
+}
@@ -4,28 +4,127 @@ package packager
 
 import (
 	"archive/zip"
-	"crypto/md5"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
+	"text/template"
+	"time"
 
+	"github.com/blang/semver"
 	"github.com/cloudfoundry/libbuildpack"
 )
 
-var CacheDir = filepath.Join(os.Getenv("HOME"), ".buildpack-packager", "cache")
+var CacheDir = defaultCacheDir()
 var Stdout, Stderr io.Writer = os.Stdout, os.Stderr
 
+// Packager holds the output streams and default cache directory used while
+// packaging, so that concurrent callers need not share the package-level
+// Stdout, Stderr and CacheDir variables.
+type Packager struct {
+	Stdout   io.Writer
+	Stderr   io.Writer
+	CacheDir string
+}
+
+func NewPackager() Packager {
+	return Packager{
+		Stdout:   os.Stdout,
+		Stderr:   os.Stderr,
+		CacheDir: defaultCacheDir(),
+	}
+}
+
+func defaultCacheDir() string {
+	return filepath.Join(os.Getenv("HOME"), ".buildpack-packager", "cache")
+}
+
+// cacheDir returns dir or, when it is empty, p.CacheDir. A Packager without
+// a CacheDir uses the default location rather than the CacheDir variable,
+// so that only the package-level functions depend on the variable.
+func (p Packager) cacheDir(dir string) string {
+	if dir != "" {
+		return dir
+	}
+	if p.CacheDir != "" {
+		return p.CacheDir
+	}
+	return defaultCacheDir()
+}
+
+// defaultPackager is used by the package-level functions and reflects the
+// current values of Stdout, Stderr and CacheDir.
+func defaultPackager() Packager {
+	return Packager{Stdout: Stdout, Stderr: Stderr, CacheDir: CacheDir}
+}
+
+// DefaultExtensionCommand runs the Ruby buildpack-packager used to package
+// buildpacks that are not packaged by this package.
+var DefaultExtensionCommand = []string{"bundle", "exec", "buildpack-packager"}
+
+// DefaultExtensionGemfile is the Gemfile the Ruby packager is run with.
+const DefaultExtensionGemfile = "cf.Gemfile"
+
+type ExtensionOptions struct {
+	BuildpackDir string
+	Version      string
+	Cached       bool
+	// Stack is a stack name, or "any".
+	Stack string
+
+	// Command is the packager to run, followed by its arguments. The
+	// cached and stack flags are added after them. Defaults to
+	// DefaultExtensionCommand.
+	Command []string
+
+	// Gemfile is passed to the command as BUNDLE_GEMFILE. Defaults to
+	// DefaultExtensionGemfile.
+	Gemfile string
+}
+
 func CompileExtensionPackage(bpDir, version string, cached bool, stack string) (string, error) {
-	bpDir, err := filepath.Abs(bpDir)
+	return defaultPackager().CompileExtensionPackage(bpDir, version, cached, stack)
+}
+
+// CompileExtensionPackageWithOptions is CompileExtensionPackage with a
+// configurable packager command. The command, and any processes it starts,
+// are killed when ctx is cancelled. The Ruby packager keeps its own cache of
+// dependencies, so no cache directory is passed to it.
+func CompileExtensionPackageWithOptions(ctx context.Context, options ExtensionOptions) (string, error) {
+	return defaultPackager().CompileExtensionPackageWithOptions(ctx, options)
+}
+
+func (p Packager) CompileExtensionPackage(bpDir, version string, cached bool, stack string) (string, error) {
+	return p.CompileExtensionPackageWithOptions(context.Background(), ExtensionOptions{
+		BuildpackDir: bpDir,
+		Version:      version,
+		Cached:       cached,
+		Stack:        stack,
+	})
+}
+
+func (p Packager) CompileExtensionPackageWithOptions(ctx context.Context, options ExtensionOptions) (string, error) {
+	version, cached, stack := options.Version, options.Cached, options.Stack
+	command := options.Command
+	if len(command) == 0 {
+		command = DefaultExtensionCommand
+	}
+	gemfile := options.Gemfile
+	if gemfile == "" {
+		gemfile = DefaultExtensionGemfile
+	}
+
+	bpDir, err := filepath.Abs(options.BuildpackDir)
 	if err != nil {
 		return "", fmt.Errorf("Failed to get the absolute path of %s: %v", bpDir, err)
 	}
@@ -33,6 +132,7 @@ func CompileExtensionPackage(bpDir, version string, cached bool, stack string) (
 	if err != nil {
 		return "", fmt.Errorf("Failed to copy %s: %v", bpDir, err)
 	}
+	defer os.RemoveAll(dir)
 
 	err = ioutil.WriteFile(filepath.Join(dir, "VERSION"), []byte(version), 0644)
 	if err != nil {
@@ -47,12 +147,19 @@ func CompileExtensionPackage(bpDir, version string, cached bool, stack string) (
 	if stack == "any" {
 		stackArg = "--any-stack"
 	}
-	cmd := exec.Command("bundle", "exec", "buildpack-packager", isCached, stackArg)
-	cmd.Stdout = Stdout
-	cmd.Stderr = Stderr
-	cmd.Env = append(os.Environ(), "BUNDLE_GEMFILE=cf.Gemfile")
+	args := append(append([]string{}, command[1:]...), isCached, stackArg)
+	cmd := exec.CommandContext(ctx, command[0], args...)
+	cmd.Stdout = p.Stdout
+	cmd.Stderr = p.Stderr
+	cmd.Env = append(os.Environ(), "BUNDLE_GEMFILE="+gemfile)
 	cmd.Dir = dir
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcessGroup(cmd) }
+	cmd.WaitDelay = time.Second
 	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
 		return "", fmt.Errorf("Failed to run %s %s: %v", cmd.Path, strings.Join(cmd.Args, " "), err)
 	}
 
@@ -64,8 +171,8 @@ func CompileExtensionPackage(bpDir, version string, cached bool, stack string) (
 		return "", fmt.Errorf("Failed to load manifest.yml: %v", err)
 	}
 
-	stackName := fmt.Sprintf("-%s", stack)
-	if stackName == "any" {
+	stackName := "-" + stack
+	if stack == "any" {
 		stackName = ""
 	}
 	zipFile := fmt.Sprintf("%s_buildpack%s-v%s.zip", manifest.Language, stackName, version)
@@ -76,9 +183,25 @@ func CompileExtensionPackage(bpDir, version string, cached bool, stack string) (
 		return "", fmt.Errorf("Failed to copy %s from %s to %s: %v", zipFile, dir, bpDir, err)
 	}
 
-	return filepath.Join(dir, zipFile), nil
+	return filepath.Join(bpDir, zipFile), nil
+}
+
+// StackNotFoundError reports packaging for a stack which no dependency of
+// the manifest is built for.
+type StackNotFoundError struct {
+	Stack string
 }
 
+func (e StackNotFoundError) Error() string {
+	return fmt.Sprintf("Stack `%s` not found in manifest", e.Stack)
+}
+
+// validateStack checks that the manifest in bpDir can be packaged for
+// stack. Default versions are resolved against the dependencies of stack
+// directly rather than through CF_STACK, so packaging never modifies the
+// process environment. The manifest is read with readManifest rather than a
+// libbuildpack.Manifest, which would need a logger, so nothing is logged and
+// every problem found is in the returned error.
 func validateStack(stack, bpDir string) error {
 	manifest, err := readManifest(bpDir)
 	if err != nil {
@@ -90,269 +213,1059 @@ func validateStack(stack, bpDir string) error {
 	}
 
 	if stack == "" {
+		// The buildpack only allows one default version of each dependency,
+		// so defaults which differ by stack need the stack to pick them.
+		for _, d := range manifest.Defaults {
+			if len(d.Stacks) > 0 {
+				return fmt.Errorf("Default version of `%s` is scoped to stacks %s, so the buildpack must be packaged for a stack", d.Name, strings.Join(d.Stacks, ", "))
+			}
+		}
 		return nil
 	}
 
 	if len(manifest.Dependencies) > 0 && !manifest.hasStack(stack) {
-		return fmt.Errorf("Stack `%s` not found in manifest", stack)
+		return StackNotFoundError{Stack: stack}
 	}
 
-	for _, d := range manifest.Defaults {
-		if _, err := libbuildpack.FindMatchingVersion(d.Version, manifest.versionsOfDependencyWithStack(d.Name, stack)); err != nil {
-			return fmt.Errorf("No matching default dependency `%s` for stack `%s`", d.Name, stack)
-		}
+	if missing := defaultVersionProblems(manifest, stack); len(missing) > 0 {
+		return errors.New(missing[0])
 	}
 
 	return nil
 }
 
+// readVersionFile reads the version from the VERSION file in bpDir.
+func readVersionFile(bpDir string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(bpDir, "VERSION"))
+	if err != nil {
+		return "", fmt.Errorf("No version given and could not read VERSION file: %v", err)
+	}
+	version := strings.TrimSpace(string(data))
+	if version == "" {
+		return "", fmt.Errorf("No version given and the VERSION file in %s is empty", bpDir)
+	}
+	return version, nil
+}
+
+// zipComment describes a packaged buildpack for the archive comment.
+func zipComment(language, version, stack string, cached bool, built time.Time) string {
+	if stack == "" {
+		stack = "any"
+	}
+	return fmt.Sprintf("language: %s\nversion: %s\nstack: %s\ncached: %t\nbuilt: %s\n", language, version, stack, cached, built.UTC().Format(time.RFC3339))
+}
+
+// ZipFileName is the name Package gives the zip of a buildpack, such as
+// ruby_buildpack-cached-cflinuxfs3-v1.2.3.zip. The stack is left out when
+// it is empty.
+func ZipFileName(language, version, stack string, cached bool) string {
+	stackPart := ""
+	if stack != "" {
+		stackPart = "-" + stack
+	}
+
+	cachedPart := ""
+	if cached {
+		cachedPart = "-cached"
+	}
+
+	return fmt.Sprintf("%s_buildpack%s%s-v%s.zip", language, cachedPart, stackPart, version)
+}
+
+// zipNamePlaceholders are the shorthands FilenameTemplate may use for the
+// fields of zipNameData.
+var zipNamePlaceholders = strings.NewReplacer(
+	"{language}", "{{.Language}}",
+	"{version}", "{{.Version}}",
+	"{stack}", "{{.Stack}}",
+	"{cached}", "{{if .Cached}}cached{{end}}",
+)
+
+type zipNameData struct {
+	Language, Version, Stack string
+	Cached                   bool
+}
+
+// renderZipFileName names the zip with nameTemplate, or with ZipFileName
+// when nameTemplate is empty. See PackageOptions.FilenameTemplate.
+func renderZipFileName(nameTemplate, language, version, stack string, cached bool) (string, error) {
+	if nameTemplate == "" {
+		return ZipFileName(language, version, stack, cached), nil
+	}
+
+	tmpl, err := template.New("zip").Option("missingkey=error").Parse(zipNamePlaceholders.Replace(nameTemplate))
+	if err != nil {
+		return "", fmt.Errorf("Invalid FilenameTemplate %q: %v", nameTemplate, err)
+	}
+	var name strings.Builder
+	if err := tmpl.Execute(&name, zipNameData{Language: language, Version: version, Stack: stack, Cached: cached}); err != nil {
+		return "", fmt.Errorf("Invalid FilenameTemplate %q: %v", nameTemplate, err)
+	}
+	if n := name.String(); n == "" || n == "." || n == ".." || strings.ContainsAny(n, `/\`) {
+		return "", fmt.Errorf("FilenameTemplate %q renders %q, which is not a file name", nameTemplate, n)
+	}
+	return name.String(), nil
+}
+
+// jsonValue converts the maps of a decoded YAML document, whose keys may
+// be of any type, to maps with string keys that encoding/json can encode.
+// encoding/json sorts the keys, so the encoding is deterministic.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			converted[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return converted
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			converted[key] = jsonValue(value)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, value := range v {
+			converted[i] = jsonValue(value)
+		}
+		return converted
+	default:
+		return v
+	}
+}
+
+// excluded reports whether dep matches one of excludes, each a name or a
+// name@version.
+func excluded(dep Dependency, excludes []string) bool {
+	for _, exclude := range excludes {
+		if exclude == dep.Name || exclude == dep.Name+"@"+dep.Version {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutExcluded returns deps less those matching excludes. Each of
+// excludes must match one of deps, since one that does not is most likely
+// a typo.
+func withoutExcluded(deps Dependencies, excludes []string) (Dependencies, error) {
+	if len(excludes) == 0 {
+		return deps, nil
+	}
+	var kept Dependencies
+	for _, dep := range deps {
+		if !excluded(dep, excludes) {
+			kept = append(kept, dep)
+		}
+	}
+
+	var unmatched []string
+	for _, exclude := range excludes {
+		matched := false
+		for _, dep := range deps {
+			matched = matched || excluded(dep, []string{exclude})
+		}
+		if !matched {
+			unmatched = append(unmatched, exclude)
+		}
+	}
+	if len(unmatched) > 0 {
+		return nil, fmt.Errorf("Excluded dependencies not found in manifest: %s", strings.Join(unmatched, ", "))
+	}
+	return kept, nil
+}
+
 func updateDependencyMap(dependencyMap interface{}, file File) error {
 	dep, ok := dependencyMap.(map[interface{}]interface{})
 	if !ok {
 		return fmt.Errorf("Could not cast deps[idx] to map[interface{}]interface{}")
 	}
-	dep["file"] = file.Name
+	dep["file"] = zipEntryName(file.Name)
 	return nil
 }
 
-func downloadDependency(dependency Dependency, cacheDir string) (File, error) {
-	file := filepath.Join("dependencies", fmt.Sprintf("%x", md5.Sum([]byte(dependency.URI))), filepath.Base(dependency.URI))
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		log.Fatalf("error: %v", err)
-	}
+// VersionCheck controls what happens when a buildpack is packaged with a
+// version that is not a semantic version.
+type VersionCheck int
+
+const (
+	// VersionCheckNone accepts any version, such as a date.
+	VersionCheckNone VersionCheck = iota
+	// VersionCheckWarn logs a warning for versions that are not semantic
+	// versions.
+	VersionCheckWarn
+	// VersionCheckStrict rejects versions that are not semantic versions.
+	VersionCheckStrict
+)
 
-	if _, err := os.Stat(filepath.Join(cacheDir, file)); err != nil {
-		if err := DownloadFromURI(dependency.URI, filepath.Join(cacheDir, file)); err != nil {
-			return File{}, err
+func checkVersion(version string, check VersionCheck, logger *libbuildpack.Logger) error {
+	if check == VersionCheckNone {
+		return nil
+	}
+	if _, err := semver.Parse(version); err != nil {
+		if check == VersionCheckStrict {
+			return fmt.Errorf("Version `%s` is not a semantic version: %v", version, err)
 		}
+		logger.Warning("Version `%s` is not a semantic version: %v", version, err)
 	}
+	return nil
+}
 
-	if err := checkSha256(filepath.Join(cacheDir, file), dependency.SHA256); err != nil {
-		return File{}, err
-	}
+type PackageOptions struct {
+	BuildpackDir string
+	CacheDir     string // defaults to the Packager's CacheDir
+	Version      string // defaults to the contents of the VERSION file
+	Stack        string
+	// Cached includes the dependencies in the zip. They are zipped straight
+	// from CacheDir, so the disk needed beyond the cache is one copy of the
+	// buildpack without its dependencies plus the zip itself. A CacheDir
+	// inside BuildpackDir is left out of that copy.
+	Cached bool
+
+	// ManifestSource, when set, is a path or http(s) URL of a manifest.yml
+	// which is packaged in place of the one in BuildpackDir.
+	ManifestSource string
+
+	// ValidateAllStacks checks that the default versions resolve on every
+	// stack in the manifest, not just Stack. See ValidateDefaultVersions.
+	ValidateAllStacks bool
+
+	// WarnUnreferenced logs a warning for each dependency for Stack that no
+	// default version selects. See UnreferencedDependencies.
+	WarnUnreferenced bool
+
+	// TempDir is where the working copy of the buildpack is made, for when
+	// the default temporary directory is too small. Empty means the default.
+	TempDir string
+
+	// VersionCheck controls whether Version must be a semantic version.
+	VersionCheck VersionCheck
+
+	// KeepVersionFile packages the buildpack's own VERSION file instead of
+	// overwriting it with Version, warning when the two differ. Version is
+	// only written when there is no VERSION file.
+	KeepVersionFile bool
+
+	// Incremental leaves an existing zip in place when the buildpack
+	// directory, options and dependencies it was built from are unchanged.
+	// The hash of those inputs is stored next to the zip with an .inputs
+	// extension.
+	Incremental bool
+
+	// Force rebuilds the zip of an Incremental build even when it is up to
+	// date.
+	Force bool
+
+	// PrePackageTimeout bounds the manifest's pre_package command. Zero
+	// means DefaultPrePackageTimeout; a negative value means no limit.
+	PrePackageTimeout time.Duration
+
+	// Timeout bounds the whole packaging run, including the downloads, the
+	// pre_package command and writing the zip, on top of their own
+	// timeouts. A zip left unfinished is removed. Zero means no limit.
+	Timeout time.Duration
+
+	// Exclude lists additional paths or glob patterns, relative to the
+	// buildpack directory, which are left out of the working copy.
+	Exclude []string
+
+	// SkipDirs overrides the directories left out of the working copy
+	// wherever they occur. See CopyOptions.SkipDirs. It is an error for
+	// include_files to name anything in a skipped directory.
+	SkipDirs []string
+
+	// AllowExternalSymlinks permits symlinks pointing outside of the
+	// buildpack directory. See CopyOptions.AllowExternalSymlinks.
+	AllowExternalSymlinks bool
+
+	// RejectSpecialFiles fails packaging on named pipes, sockets and
+	// devices in the buildpack directory, rather than skipping them with a
+	// warning. See CopyOptions.RejectSpecialFiles.
+	RejectSpecialFiles bool
+
+	// Logger receives progress and diagnostic output. It defaults to a
+	// logger writing to the Packager's Stdout.
+	Logger *libbuildpack.Logger
+
+	// KeepGoing downloads and verifies every dependency even after some
+	// have failed, so that packaging fails with all of the failures at
+	// once rather than just the first.
+	KeepGoing bool
+
+	// MaxConcurrentDownloads caps how many dependencies are downloaded at
+	// once when packaging a cached buildpack. Zero means
+	// DefaultMaxConcurrentDownloads; one downloads them serially.
+	MaxConcurrentDownloads int
+
+	// DependencyTimeout bounds the download of each dependency that does not
+	// set its own download_timeout in the manifest. Zero means no limit.
+	DependencyTimeout time.Duration
+
+	// UserAgent is sent with every dependency request. Empty means
+	// DefaultUserAgent.
+	UserAgent string
+
+	// HTTPClient makes dependency requests. Nil means a client made for
+	// the run, shared by all of its downloads so that connections are kept
+	// alive and reused, and closed at the end.
+	HTTPClient *http.Client
+
+	// MaxIdleConnsPerHost and IdleConnTimeout tune how the connections of
+	// that client are kept alive between requests. Zero means as many as
+	// MaxConcurrentDownloads and the http.DefaultTransport timeout. They
+	// do not apply to HTTPClient.
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	// MaxBytesPerSecond limits the bandwidth of each dependency download.
+	// Zero means no limit.
+	MaxBytesPerSecond int64
+
+	// MaxDependencySize fails the download of any dependency larger than
+	// it, in bytes, guarding the cache against unbounded responses. Zero
+	// means no limit.
+	MaxDependencySize int64
+
+	// UseNetrc applies basic auth to dependency requests for hosts with an
+	// entry in the .netrc file named by $NETRC, or ~/.netrc.
+	UseNetrc bool
+
+	// URIRewrites redirect dependency downloads, such as to a mirror,
+	// without changing the manifest. The first rule whose Match matches a
+	// dependency's uri replaces it; the checksum is still verified against
+	// what is downloaded.
+	URIRewrites []URIRewrite
+
+	// CheckURIs sends a HEAD request for every dependency of the stack
+	// before anything is copied or downloaded, failing with every URI that
+	// is unreachable. file:// URIs are not checked.
+	CheckURIs bool
+
+	// DependencyPool is a directory of dependencies, laid out flat and
+	// managed outside of the packager, which are packaged instead of being
+	// downloaded into the cache. Each is found by the last element of its
+	// uri, or by the file DependencyPoolNames maps its name@version to,
+	// and verified against its checksums. Packaging fails, listing them,
+	// when any are missing. Dependencies from the pool count as cache hits.
+	DependencyPool      string
+	DependencyPoolNames map[string]string
+
+	// OnProgress, when set, is called as dependencies are downloaded with
+	// the progress of the dependency and of the run as a whole. To know the
+	// overall total, the size of every dependency not yet cached is asked
+	// for with a HEAD request first. Calls are never made concurrently.
+	OnProgress func(Progress)
+
+	// Events, when set, receives a JSON Event per line as packaging
+	// progresses.
+	Events io.Writer
+
+	// AllowUnchecked accepts dependencies that declare no checksum. They
+	// are packaged without being verified, with a warning. Meant for local
+	// experiments only.
+	AllowUnchecked bool
+
+	// SkipFileChecksums skips verifying the checksums of file://
+	// dependencies, with a warning, so that local dependencies can change
+	// without the manifest being updated. They are copied afresh on every
+	// build. Dependencies fetched over the network are always verified.
+	SkipFileChecksums bool
+
+	// SkipZipVerification disables reading the zip back after writing it.
+	SkipZipVerification bool
+
+	// NormalizeModes stores every entry with 0755 or 0644 permissions. See
+	// ZipOptions.NormalizeModes.
+	NormalizeModes bool
+
+	// Compressor replaces the deflate compressor used for the zip. See
+	// ZipOptions.Compressor.
+	Compressor zip.Compressor
+
+	// ZipComment records the language, version, stack and build time of
+	// the buildpack in the zip's archive comment.
+	ZipComment bool
+
+	// FilenameTemplate names the zip instead of the default
+	// <language>_buildpack[-cached][-<stack>]-v<version>.zip. It is a
+	// text/template over .Language, .Version, .Stack and .Cached, in which
+	// {language}, {version} and {stack} stand for the first three and
+	// {cached} for "cached" when Cached is set. {stack} is empty for a
+	// buildpack built for any stack. The name may not contain a path
+	// separator.
+	FilenameTemplate string
+
+	// ReleaseSummary writes a ReleaseSummary of the buildpack as JSON to
+	// <zip>.json, returned as Result.ReleaseSummaryFile. It is not written
+	// when packaging to a writer.
+	ReleaseSummary bool
+
+	// ChecksumIndex adds ChecksumIndexName to cached zips, listing the
+	// sha256 of every dependency in the zip so that it can be verified
+	// after extraction without the original manifest.
+	ChecksumIndex bool
+
+	// ManifestJSON also adds the packaged manifest to the zip as
+	// manifest.json, for consumers without a YAML parser. manifest.yml
+	// remains the manifest the buildpack uses.
+	ManifestJSON bool
+
+	// ExtraFiles are added to the zip from memory, alongside the
+	// include_files and dependencies.
+	ExtraFiles []ExtraFile
+
+	// TransformManifest, when set, may change the manifest, once its stack
+	// and dependencies are set, before it is written to the buildpack. An
+	// error fails packaging. Incremental packaging cannot tell when the
+	// hook itself changes; use Force then.
+	TransformManifest func(m map[string]interface{}) error
+
+	// Verbose logs diagnostics to Logger: whether each dependency was found
+	// in the cache, uri rewrites, the paths left out of the buildpack and
+	// why, dependencies left out for the stack, and how each file was
+	// compressed.
+	Verbose bool
+
+	// ExcludeDependencies leaves dependencies out of the buildpack, and its
+	// manifest, without editing the manifest. Each is a name, matching every
+	// version, or a name@version. Packaging fails when one matches no
+	// dependency of the manifest.
+	ExcludeDependencies []string
+
+	// ExtraDependencies are downloaded, verified and added under
+	// dependencies/ like those of the manifest, which does not list them.
+	// They are included whether or not the buildpack is cached, and
+	// whatever the stack.
+	ExtraDependencies []Dependency
+
+	// SigningKey is the path to an ASCII-armored GPG private key. When set, a
+	// detached signature of the finished zip is written next to it.
+	SigningKey string
+}
+
+type Result struct {
+	ZipFile       string
+	SignatureFile string
+	Size          int64
+	SHA256        string
+	Files         []string
+	Dependencies  []ResolvedDependency
+
+	// Stacks are the stacks the buildpack covers: the one packaged for or,
+	// when packaging for any stack, those of the packaged dependencies.
+	Stacks []string
 
-	return File{file, filepath.Join(cacheDir, file)}, nil
+	// UpToDate is set when an incremental build found the zip already
+	// built from the same inputs and left it in place.
+	UpToDate bool
+
+	// GitCommit is the sha of the commit packaged by PackageFromGit.
+	GitCommit string
+
+	// ReleaseSummaryFile is the path of the JSON written when
+	// PackageOptions.ReleaseSummary is set.
+	ReleaseSummaryFile string
+}
+
+// URIRewrite replaces the parts of a uri matching the regular expression
+// Match with Replacement, which may refer to submatches as in
+// regexp.Regexp.ReplaceAllString.
+type URIRewrite struct {
+	Match       string
+	Replacement string
+}
+
+type ResolvedDependency struct {
+	Name    string
+	Version string
+	URI     string
+	SHA256  string
+
+	// Included is set when the dependency is in the zip: for cached
+	// buildpacks and for PackageOptions.ExtraDependencies.
+	Included bool
+
+	// Download is only set for dependencies in the zip.
+	Download DownloadStats
 }
 
 func Package(bpDir, cacheDir, version, stack string, cached bool) (string, error) {
-	log.Printf("Test Test")
+	return defaultPackager().Package(bpDir, cacheDir, version, stack, cached)
+}
 
-	bpDir, err := filepath.Abs(bpDir)
+func PackageWithOptions(options PackageOptions) (Result, error) {
+	return defaultPackager().PackageWithOptions(options)
+}
+
+// PackageWithContext packages a buildpack like PackageWithOptions, giving
+// up once ctx is done.
+func PackageWithContext(ctx context.Context, options PackageOptions) (Result, error) {
+	return defaultPackager().PackageWithContext(ctx, options)
+}
+
+// Package builds a buildpack zip, using p.CacheDir when cacheDir is empty.
+func (p Packager) Package(bpDir, cacheDir, version, stack string, cached bool) (string, error) {
+	result, err := p.PackageWithOptions(PackageOptions{
+		BuildpackDir: bpDir,
+		CacheDir:     cacheDir,
+		Version:      version,
+		Stack:        stack,
+		Cached:       cached,
+	})
+	return result.ZipFile, err
+}
+
+// PackageToWriter packages a buildpack like PackageWithOptions but streams
+// the zip to w instead of writing it next to the buildpack, so Result has
+// no ZipFile. Since the archive cannot be read back it is neither verified
+// nor signed, and Incremental has no effect.
+func PackageToWriter(options PackageOptions, w io.Writer) (Result, error) {
+	return defaultPackager().PackageToWriter(options, w)
+}
+
+func (p Packager) PackageWithOptions(options PackageOptions) (Result, error) {
+	return p.PackageWithContext(context.Background(), options)
+}
+
+func (p Packager) PackageWithContext(ctx context.Context, options PackageOptions) (Result, error) {
+	return p.packageTo(ctx, options, nil)
+}
+
+func (p Packager) PackageToWriter(options PackageOptions, w io.Writer) (Result, error) {
+	if options.SigningKey != "" {
+		return Result{}, fmt.Errorf("Cannot sign a buildpack packaged to a writer")
+	}
+	options.Incremental = false
+	return p.packageTo(context.Background(), options, w)
+}
+
+// packageTo packages a buildpack, writing the zip to w or, when w is nil,
+// to a file in the buildpack directory. It gives up once ctx is done or
+// options.Timeout has passed.
+func (p Packager) packageTo(ctx context.Context, options PackageOptions, w io.Writer) (Result, error) {
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+	result, err := p.packageWithin(ctx, options, w)
+	if err != nil && options.Timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		return Result{}, fmt.Errorf("Packaging timed out after %s: %w", options.Timeout, err)
+	}
+	return result, err
+}
+
+func (p Packager) packageWithin(ctx context.Context, options PackageOptions, w io.Writer) (Result, error) {
+	cacheDir, version, stack, cached := p.cacheDir(options.CacheDir), options.Version, options.Stack, options.Cached
+	logger := options.Logger
+	if logger == nil {
+		logger = libbuildpack.NewLogger(p.Stdout)
+	}
+	verbose := func(format string, args ...interface{}) {
+		if options.Verbose {
+			logger.Info(format, args...)
+		}
+	}
+	events := newEventEmitter(options.Events)
+
+	if options.SigningKey != "" {
+		if _, err := os.Stat(options.SigningKey); err != nil {
+			return Result{}, fmt.Errorf("Failed to read signing key %s: %v", options.SigningKey, err)
+		}
+	}
+
+	bpDir, err := filepath.Abs(options.BuildpackDir)
 	if err != nil {
-		return "", err
+		return Result{}, err
+	}
+
+	writeVersion := version != ""
+	if writeVersion && options.KeepVersionFile {
+		if existing, err := readVersionFile(bpDir); err == nil {
+			if existing != version {
+				logger.Warning("Version %s differs from the VERSION file, packaging %s", version, existing)
+			}
+			version, writeVersion = existing, false
+		}
+	}
+	if version == "" {
+		if version, err = readVersionFile(bpDir); err != nil {
+			return Result{}, err
+		}
+	}
+	if err := checkVersion(version, options.VersionCheck, logger); err != nil {
+		return Result{}, err
+	}
+
+	d, err := newDownloader(options, cacheDir, logger)
+	if err != nil {
+		return Result{}, err
+	}
+	defer d.close()
+	d.events = events
+
+	// manifestDir holds the manifest.yml that is validated and packaged.
+	manifestDir := bpDir
+	if options.ManifestSource != "" {
+		if manifestDir, err = d.fetchManifest(ctx, options.ManifestSource); err != nil {
+			return Result{}, err
+		}
+		defer os.RemoveAll(manifestDir)
 	}
-	err = validateStack(stack, bpDir)
+
+	if err := validateManifest(manifestDir, options.AllowUnchecked); err != nil {
+		return Result{}, err
+	}
+	if source, err := readManifest(manifestDir); err == nil {
+		for _, warning := range strayStackWarnings(source) {
+			logger.Warning("%s", warning)
+		}
+	}
+	err = validateStack(stack, manifestDir)
 	if err != nil {
-		return "", err
+		return Result{}, err
 	}
-	dir, err := CopyDirectory(bpDir)
+	if options.FilenameTemplate != "" {
+		// Catch a bad template before anything is downloaded.
+		source, err := readManifest(manifestDir)
+		if err != nil {
+			return Result{}, err
+		}
+		if _, err := renderZipFileName(options.FilenameTemplate, source.Language, version, stack, cached); err != nil {
+			return Result{}, err
+		}
+	}
+
+	var inputs, existingZip string
+	if options.Incremental {
+		source, err := readManifest(manifestDir)
+		if err != nil {
+			return Result{}, err
+		}
+		name, err := renderZipFileName(options.FilenameTemplate, source.Language, version, stack, cached)
+		if err != nil {
+			return Result{}, err
+		}
+		existingZip = filepath.Join(bpDir, name)
+		if source.Dependencies, err = withoutExcluded(source.Dependencies, options.ExcludeDependencies); err != nil {
+			return Result{}, err
+		}
+		extras := options.ExtraFiles
+		// The contents of the generated files follow from the manifest and
+		// dependencies, which are hashed already.
+		if cached && options.ChecksumIndex {
+			extras = append(append([]ExtraFile{}, extras...), ExtraFile{Name: ChecksumIndexName})
+		}
+		if options.ManifestJSON {
+			extras = append(append([]ExtraFile{}, extras...), ExtraFile{Name: "manifest.json"})
+		}
+		if inputs, err = inputsHash(bpDir, manifestDir, source, options, version, stack, cached, extras); err != nil {
+			return Result{}, err
+		}
+		_, summaryErr := os.Stat(releaseSummaryPath(existingZip))
+		if !options.Force && upToDate(existingZip, inputs, options.SigningKey != "") && (!options.ReleaseSummary || summaryErr == nil) {
+			logger.Info("%s is up to date", existingZip)
+			return existingResult(existingZip, source, options.ExtraDependencies, stack, cached, options.ReleaseSummary)
+		}
+	}
+
+	if options.ValidateAllStacks {
+		if err := ValidateDefaultVersions(manifestDir); err != nil {
+			return Result{}, err
+		}
+	}
+	if options.WarnUnreferenced {
+		unreferenced, err := UnreferencedDependencies(manifestDir, stack)
+		if err != nil {
+			return Result{}, err
+		}
+		for _, dep := range unreferenced {
+			logger.Warning("Dependency %s %s (%s) is not selected by any default version", dep.Name, dep.Version, dep.URI)
+		}
+	}
+
+	if options.CheckURIs {
+		if err := d.checkURIs(ctx, stack, manifestDir); err != nil {
+			return Result{}, err
+		}
+	}
+	// Dependencies are zipped from the cache, so copying a cache kept in
+	// the buildpack would only duplicate them.
+	exclude := options.Exclude
+	if absCacheDir, err := filepath.Abs(cacheDir); err == nil && absCacheDir != bpDir && withinDir(bpDir, absCacheDir) {
+		rel, _ := filepath.Rel(bpDir, absCacheDir)
+		exclude = append(append([]string{}, exclude...), filepath.ToSlash(rel))
+	}
+	source, err := readManifest(manifestDir)
 	if err != nil {
-		return "", err
+		return Result{}, err
+	}
+	if err := checkSkippedIncludes(bpDir, source.IncludeFiles, options.SkipDirs); err != nil {
+		return Result{}, err
+	}
+	dir, err := CopyDirectoryWithOptions(bpDir, CopyOptions{
+		Exclude:               exclude,
+		SkipDirs:              options.SkipDirs,
+		AllowExternalSymlinks: options.AllowExternalSymlinks,
+		RejectSpecialFiles:    options.RejectSpecialFiles,
+		Logger:                logger,
+		Verbose:               options.Verbose,
+		TempDir:               options.TempDir,
+	})
+	if err != nil {
+		return Result{}, err
 	}
 	defer os.RemoveAll(dir)
 
-	err = ioutil.WriteFile(filepath.Join(dir, "VERSION"), []byte(version), 0644)
-	if err != nil {
-		return "", err
+	if manifestDir != bpDir {
+		if err := libbuildpack.CopyFile(filepath.Join(manifestDir, "manifest.yml"), filepath.Join(dir, "manifest.yml")); err != nil {
+			return Result{}, err
+		}
+	}
+
+	if writeVersion {
+		err = ioutil.WriteFile(filepath.Join(dir, "VERSION"), []byte(version), 0644)
+		if err != nil {
+			return Result{}, err
+		}
 	}
 
 	manifest, err := readManifest(dir)
 	if err != nil {
-		return "", err
+		return Result{}, err
 	}
 
 	if manifest.PrePackage != "" {
-		cmd := exec.Command(manifest.PrePackage)
-		cmd.Dir = dir
-		out, err := cmd.CombinedOutput()
+		stdout, stderr, combined := p.Stdout, p.Stderr, false
+		if options.Logger != nil {
+			stdout, combined = logger.Output(), true
+		}
+		timeout := options.PrePackageTimeout
+		if timeout == 0 {
+			timeout = DefaultPrePackageTimeout
+		}
+		out, err := runPrePackage(ctx, manifest, dir, prePackageEnv(version, stack, cached), stdout, stderr, combined, timeout)
 		if err != nil {
-			fmt.Fprintln(Stdout, string(out))
-			return "", err
+			logger.Error("Failed to run pre_package %s: %v", manifest.PrePackage, err)
+			return Result{}, fmt.Errorf("Failed to run pre_package %s: %v\n%s", manifest.PrePackage, err, strings.TrimSpace(out))
 		}
 	}
 
+	includeFiles, err := expandIncludeFiles(dir, manifest.IncludeFiles)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := checkIncludeFiles(dir, includeFiles); err != nil {
+		return Result{}, err
+	}
+
 	files := []File{}
-	for _, name := range manifest.IncludeFiles {
+	for _, name := range includeFiles {
 		files = append(files, File{name, filepath.Join(dir, name)})
 	}
 
 	var m map[string]interface{}
 	if err := libbuildpack.NewYAML().Load(filepath.Join(dir, "manifest.yml"), &m); err != nil {
-		return "", err
+		return Result{}, err
 	}
 
 	if stack != "" {
 		m["stack"] = stack
+
+		// Only the default versions for stack apply, and the buildpack
+		// allows one of each.
+		if defaults, ok := m["default_versions"].([]interface{}); ok && len(defaults) == len(manifest.Defaults) {
+			defaultsForStack := []interface{}{}
+			for _, i := range manifest.stackDefaults(stack) {
+				if entry, ok := defaults[i].(map[interface{}]interface{}); ok {
+					delete(entry, "cf_stacks")
+				}
+				defaultsForStack = append(defaultsForStack, defaults[i])
+			}
+			m["default_versions"] = defaultsForStack
+		}
 	}
 
+	// A buildpack with nothing to download may leave dependencies out.
 	deps, ok := m["dependencies"].([]interface{})
-	if !ok {
-		return "", fmt.Errorf("Could not cast dependencies to []interface{}")
+	if !ok && m["dependencies"] != nil {
+		return Result{}, fmt.Errorf("Could not cast dependencies to []interface{}")
 	}
-	dependenciesForStack := []interface{}{}
+	packaged, err := withoutExcluded(manifest.Dependencies, options.ExcludeDependencies)
+	if err != nil {
+		return Result{}, err
+	}
+	selected := []int{}
 	for idx, d := range manifest.Dependencies {
-		for _, s := range d.Stacks {
-			if stack == "" || s == stack {
-				dependencyMap := deps[idx]
-				if cached {
-					if file, err := downloadDependency(d, cacheDir); err != nil {
-						return "", err
-					} else {
-						updateDependencyMap(dependencyMap, file)
-						files = append(files, file)
-					}
-				}
-				if stack != "" {
-					delete(dependencyMap.(map[interface{}]interface{}), "cf_stacks")
-				}
-				dependenciesForStack = append(dependenciesForStack, dependencyMap)
-				break
-			}
+		switch {
+		case !forStack(d, stack):
+			verbose("Leaving out %s %s: not built for stack %s", d.Name, d.Version, stack)
+		case excluded(d, options.ExcludeDependencies):
+			verbose("Leaving out %s %s: excluded", d.Name, d.Version)
+		default:
+			selected = append(selected, idx)
 		}
 	}
-	m["dependencies"] = dependenciesForStack
 
-	if err := libbuildpack.NewYAML().Write(filepath.Join(dir, "manifest.yml"), m); err != nil {
-		return "", err
+	selectedDeps := []Dependency{}
+	for _, idx := range selected {
+		selectedDeps = append(selectedDeps, manifest.Dependencies[idx])
 	}
-
-	stackPart := ""
-	if stack != "" {
-		stackPart = "-" + stack
+	if err := d.checkIncludedDependencies(dir, includeFiles, selectedDeps); err != nil {
+		return Result{}, err
 	}
 
-	cachedPart := ""
-	if cached {
-		cachedPart = "-cached"
+	var downloaded []File
+	var stats []DownloadStats
+	if cached || len(options.ExtraDependencies) > 0 {
+		toDownload := []Dependency{}
+		if cached {
+			for _, idx := range selected {
+				toDownload = append(toDownload, manifest.Dependencies[idx])
+			}
+		}
+		toDownload = append(toDownload, options.ExtraDependencies...)
+		if downloaded, stats, err = d.downloadDependencies(ctx, toDownload); err != nil {
+			return Result{}, err
+		}
 	}
 
-	fileName := fmt.Sprintf("%s_buildpack%s%s-v%s.zip", manifest.Language, cachedPart, stackPart, version)
-	zipFile := filepath.Join(bpDir, fileName)
-
-	if err := ZipFiles(zipFile, files); err != nil {
-		return "", err
+	dependenciesForStack := []interface{}{}
+	resolved := []ResolvedDependency{}
+	// Dependencies sharing a uri, such as one built for several stacks but
+	// listed once per stack, share a file in the zip.
+	zipped := map[string]bool{}
+	var dependencyFiles []File
+	for i, idx := range selected {
+		d := manifest.Dependencies[idx]
+		dependencyMap := deps[idx]
+		dependency := ResolvedDependency{Name: d.Name, Version: d.Version, URI: d.URI, SHA256: d.SHA256}
+		if cached {
+			file := downloaded[i]
+			dependency.Included = true
+			dependency.Download = stats[i]
+			if err := updateDependencyMap(dependencyMap, file); err != nil {
+				return Result{}, err
+			}
+			if !zipped[file.Name] {
+				zipped[file.Name] = true
+				files = append(files, file)
+				dependencyFiles = append(dependencyFiles, file)
+			}
+		}
+		if stack != "" {
+			entry, ok := dependencyMap.(map[interface{}]interface{})
+			if !ok {
+				return Result{}, fmt.Errorf("Could not cast deps[idx] to map[interface{}]interface{}")
+			}
+			delete(entry, "cf_stacks")
+		}
+		dependenciesForStack = append(dependenciesForStack, dependencyMap)
+		resolved = append(resolved, dependency)
 	}
-
-	return zipFile, err
-}
-
-func DownloadFromURI(uri, fileName string) error {
-	err := os.MkdirAll(filepath.Dir(fileName), 0755)
-	if err != nil {
-		return err
+	for i, d := range options.ExtraDependencies {
+		i += len(downloaded) - len(options.ExtraDependencies)
+		file := downloaded[i]
+		if !zipped[file.Name] {
+			zipped[file.Name] = true
+			files = append(files, file)
+			dependencyFiles = append(dependencyFiles, file)
+		}
+		resolved = append(resolved, ResolvedDependency{Name: d.Name, Version: d.Version, URI: d.URI, SHA256: d.SHA256, Included: true, Download: stats[i]})
 	}
+	m["dependencies"] = dependenciesForStack
 
-	output, err := os.Create(fileName)
-	if err != nil {
-		return err
+	if options.TransformManifest != nil {
+		if err := options.TransformManifest(m); err != nil {
+			return Result{}, fmt.Errorf("Failed to transform manifest: %v", err)
+		}
 	}
-	defer output.Close()
 
-	u, err := url.Parse(uri)
-	if err != nil {
-		return err
+	if err := libbuildpack.NewYAML().Write(filepath.Join(dir, "manifest.yml"), m); err != nil {
+		return Result{}, err
 	}
 
-	var source io.ReadCloser
+	built := time.Now()
+	zipOptions := ZipOptions{
+		Context: ctx,
+		OnFile: func(file File) {
+			events.emit(Event{Event: "zip", File: file.Name})
+			if isCompressed(file.Name) {
+				verbose("Zipped %s: stored, since it is compressed already", file.Name)
+			} else {
+				verbose("Zipped %s: deflated", file.Name)
+			}
+		},
+		SkipVerify: options.SkipZipVerification,
+		ExtraFiles: append([]ExtraFile{}, options.ExtraFiles...),
 
-	if u.Scheme == "file" {
-		source, err = os.Open(u.Path)
+		NormalizeModes: options.NormalizeModes,
+		Compressor:     options.Compressor,
+	}
+	if cached && options.ChecksumIndex {
+		index, err := checksumIndex(dependencyFiles)
 		if err != nil {
-			return err
+			return Result{}, err
 		}
-		defer source.Close()
-	} else {
-		response, err := http.Get(uri)
+		zipOptions.ExtraFiles = append(zipOptions.ExtraFiles, index)
+	}
+	if options.ManifestJSON {
+		data, err := json.MarshalIndent(jsonValue(m), "", "  ")
 		if err != nil {
-			return err
-		}
-		defer response.Body.Close()
-		source = response.Body
-
-		if response.StatusCode < 200 || response.StatusCode > 299 {
-			return fmt.Errorf("could not download: %d", response.StatusCode)
+			return Result{}, fmt.Errorf("Failed to encode manifest.json: %v", err)
 		}
+		zipOptions.ExtraFiles = append(zipOptions.ExtraFiles, ExtraFile{Name: "manifest.json", Contents: append(data, '\n')})
+	}
+	if options.ZipComment {
+		zipOptions.Comment = zipComment(manifest.Language, version, stack, cached, built)
 	}
 
-	_, err = io.Copy(output, source)
+	result := Result{Dependencies: resolved, Stacks: packagedStacks(Manifest{Dependencies: packaged}, stack)}
+	for _, file := range files {
+		result.Files = append(result.Files, file.Name)
+	}
+	for _, extra := range zipOptions.ExtraFiles {
+		result.Files = append(result.Files, extra.Name)
+	}
 
-	return err
-}
+	if w != nil {
+		hash := sha256.New()
+		counter := &countingWriter{w: io.MultiWriter(w, hash)}
+		if _, err := writeZipTo(counter, files, zipOptions); err != nil {
+			return Result{}, err
+		}
+		result.Size = counter.n
+		result.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		events.emit(Event{Event: "done", SHA256: result.SHA256})
+		return result, nil
+	}
 
-func checkSha256(filePath, expectedSha256 string) error {
-	content, err := ioutil.ReadFile(filePath)
+	zipName, err := renderZipFileName(options.FilenameTemplate, manifest.Language, version, stack, cached)
 	if err != nil {
-		return err
+		return Result{}, err
 	}
+	zipFile := filepath.Join(bpDir, zipName)
+	os.Remove(inputsPath(zipFile))
+	os.Remove(releaseSummaryPath(zipFile))
 
-	sum := sha256.Sum256(content)
-
-	actualSha256 := hex.EncodeToString(sum[:])
-
-	if actualSha256 != expectedSha256 {
-		return fmt.Errorf("dependency sha256 mismatch: expected sha256 %s, actual sha256 %s", expectedSha256, actualSha256)
+	if err := ZipFilesWithOptions(zipFile, files, zipOptions); err != nil {
+		return Result{}, err
 	}
-	return nil
-}
+	result.ZipFile = zipFile
 
-func ZipFiles(filename string, files []File) error {
-	newfile, err := os.Create(filename)
+	stat, err := os.Stat(zipFile)
 	if err != nil {
-		return err
+		return Result{}, err
 	}
-	defer newfile.Close()
-
-	zipWriter := zip.NewWriter(newfile)
-	defer zipWriter.Close()
+	result.Size = stat.Size()
 
-	// Add files to zip
-	for _, file := range files {
+	if result.SHA256, err = sha256File(zipFile); err != nil {
+		return Result{}, err
+	}
 
-		zipfile, err := os.Open(file.Path)
-		if err != nil {
-			returnErr := fmt.Errorf("failed to open included_file: %s, %v", file.Path, err)
-			err = os.Remove(filename)
-			if err != nil {
-				returnErr = fmt.Errorf("%s. Failed to remove broken buildpack file: %s", returnErr.Error(), filename)
-			}
-			return returnErr
+	if options.SigningKey != "" {
+		if result.SignatureFile, err = SignFile(zipFile, options.SigningKey); err != nil {
+			return Result{}, err
 		}
-		defer zipfile.Close()
-
-		// Get the file information
-		info, err := zipfile.Stat()
-		if err != nil {
-			return err
+	}
+	// Nothing is left behind by a run that ran out of time.
+	if err := ctx.Err(); err != nil {
+		os.Remove(zipFile)
+		if result.SignatureFile != "" {
+			os.Remove(result.SignatureFile)
 		}
+		return Result{}, err
+	}
 
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
+	if options.ReleaseSummary {
+		if result.ReleaseSummaryFile, err = writeReleaseSummary(zipFile, manifest, version, stack, result, built); err != nil {
+			return Result{}, err
 		}
+	}
 
-		// Change to deflate to gain better compression
-		// see http://golang.org/pkg/archive/zip/#pkg-constants
-		header.Method = zip.Deflate
-		header.Name = file.Name
-
-		writer, err := zipWriter.CreateHeader(header)
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			if _, err = io.Copy(writer, zipfile); err != nil {
-				return err
-			}
+	// Only record the inputs once the zip is complete, and only for the zip
+	// they were computed for.
+	if options.Incremental && zipFile == existingZip {
+		if err := ioutil.WriteFile(inputsPath(zipFile), []byte(inputs+"\n"), 0644); err != nil {
+			return Result{}, err
 		}
 	}
-	return nil
+
+	events.emit(Event{Event: "done", Zip: result.ZipFile, SHA256: result.SHA256})
+
+	return result, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
 }
 
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// CopyOptions controls CopyDirectoryWithOptions. Paths matching the
+// gitignore-style patterns in a .buildpackignore file at the root of the
+// source directory are always skipped.
+type CopyOptions struct {
+	// Exclude lists paths, relative to the source directory, which are not
+	// copied in addition to SkipDirs. Entries may be glob patterns (see
+	// path.Match) or plain paths, which also exclude everything beneath
+	// them.
+	Exclude []string
+
+	// SkipDirs names directories which are skipped wherever they occur in
+	// the tree. A nil slice means DefaultSkipDirs; an empty, non-nil slice
+	// copies everything.
+	SkipDirs []string
+
+	// AllowExternalSymlinks permits symlinks whose targets lie outside the
+	// source directory. By default such links are an error, since they would
+	// be packaged and could be followed out of the extraction directory.
+	AllowExternalSymlinks bool
+
+	// RejectSpecialFiles makes named pipes, sockets, devices and other
+	// files which are neither regular files, directories nor symlinks an
+	// error. By default they are skipped, with a warning to Logger when it
+	// is set, since reading them could hang or fail.
+	RejectSpecialFiles bool
+	Logger             *libbuildpack.Logger
+
+	// Verbose logs each path left out of the copy, and why, to Logger.
+	Verbose bool
+
+	// TempDir is the directory the copy is created in. Empty means the
+	// default directory for temporary files.
+	TempDir string
+}
+
+var DefaultSkipDirs = []string{".git", "tests"}
+
 func CopyDirectory(srcDir string) (string, error) {
-	destDir, err := ioutil.TempDir("", "buildpack-packager")
+	return CopyDirectoryWithOptions(srcDir, CopyOptions{})
+}
+
+func CopyDirectoryWithOptions(srcDir string, options CopyOptions) (string, error) {
+	ignores, err := readIgnoreFile(filepath.Join(srcDir, IgnoreFile))
 	if err != nil {
 		return "", err
 	}
+	skipDirs := options.SkipDirs
+	if skipDirs == nil {
+		skipDirs = DefaultSkipDirs
+	}
+
+	destDir, err := ioutil.TempDir(options.TempDir, "buildpack-packager")
+	if err != nil {
+		return "", err
+	}
+	var dirs []string
+	dirTimes := map[string]time.Time{}
 	err = filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -362,8 +1275,33 @@ func CopyDirectory(srcDir string) (string, error) {
 			return err
 		}
 
-		if path == ".git" || path == "tests" {
-			return filepath.SkipDir
+		skip := func(reason string) error {
+			if options.Verbose && options.Logger != nil {
+				options.Logger.Info("Skipping '%s': %s", path, reason)
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() && path != "." && isSkippedDir(path, skipDirs) {
+			return skip("skipped directory")
+		}
+		if path != "." && isExcluded(path, options.Exclude) {
+			return skip("excluded")
+		}
+		if path != "." && ignores.ignored(path, info.IsDir()) {
+			return skip("ignored by " + IgnoreFile)
+		}
+
+		if special := specialFileType(info.Mode()); special != "" {
+			if options.RejectSpecialFiles {
+				return fmt.Errorf("Cannot copy '%s', which is a %s", path, special)
+			}
+			if options.Logger != nil {
+				options.Logger.Warning("Skipping '%s', which is a %s", path, special)
+			}
+			return nil
 		}
 
 		dest := filepath.Join(destDir, path)
@@ -373,6 +1311,13 @@ func CopyDirectory(srcDir string) (string, error) {
 			if err != nil {
 				return fmt.Errorf("Error while reading symlink '%s': %v", srcPath, err)
 			}
+			resolved, err := resolveSymlinkChain(srcDir, srcPath)
+			if err != nil {
+				return err
+			}
+			if !options.AllowExternalSymlinks && !withinDir(srcDir, resolved) {
+				return fmt.Errorf("Symlink '%s' points to '%s', which is outside of %s", path, target, srcDir)
+			}
 			if err := os.Symlink(target, dest); err != nil {
 				return fmt.Errorf("Error while creating '%s' as symlink to '%s': %v", dest, target, err)
 			}
@@ -381,41 +1326,161 @@ func CopyDirectory(srcDir string) (string, error) {
 			if err != nil {
 				return err
 			}
+			dirs = append(dirs, dest)
+			dirTimes[dest] = info.ModTime()
 		} else {
-			src, err := os.Open(filepath.Join(srcDir, path))
-			if err != nil {
-				return err
-			}
-			defer src.Close()
+			return copyFileEntry(filepath.Join(srcDir, path), dest, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return destDir, err
+	}
 
-			err = os.MkdirAll(filepath.Dir(dest), 0755)
-			if err != nil {
-				return err
-			}
+	// Directory times are restored last, deepest first, since creating their
+	// contents updates them.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirs[i], dirTimes[dirs[i]], dirTimes[dirs[i]]); err != nil {
+			return destDir, err
+		}
+	}
+	return destDir, nil
+}
 
-			fh, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-			if err != nil {
-				return err
-			}
+// copyFileEntry copies the file at srcPath, described by info, to dest with
+// its mode and modification time. Both files are closed before it returns,
+// so that copying a buildpack of many files does not run out of
+// descriptors.
+func copyFileEntry(srcPath, dest string, info os.FileInfo) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
 
-			_, err = io.Copy(fh, src)
-			if err != nil {
-				return err
-			}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
 
-			err = fh.Chmod(info.Mode())
-			if err != nil {
-				return err
-			}
+	fh, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fh, src); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Chmod(info.Mode()); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
 
-			err = fh.Close()
-			if err != nil {
-				return err
+	return os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
+
+// specialFileType describes a mode which CopyDirectoryWithOptions cannot
+// copy, or returns "" for regular files, directories and symlinks.
+func specialFileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	case mode&os.ModeIrregular != 0:
+		return "irregular file"
+	}
+	return ""
+}
+
+// resolveSymlinkTarget returns the cleaned path that a link at linkPath with
+// the given target refers to.
+func resolveSymlinkTarget(linkPath, target string) string {
+	if filepath.IsAbs(target) {
+		return filepath.Clean(target)
+	}
+	return filepath.Join(filepath.Dir(linkPath), target)
+}
+
+// resolveSymlinkChain follows the symlink at linkPath, and any symlinks its
+// target leads on to, returning the path finally referred to. A chain that
+// comes back to a link it has already followed is an error naming the
+// links, relative to dir, around the cycle.
+func resolveSymlinkChain(dir, linkPath string) (string, error) {
+	rel := func(path string) string {
+		if r, err := filepath.Rel(dir, path); err == nil && withinDir(dir, path) {
+			return filepath.ToSlash(r)
+		}
+		return path
+	}
+
+	var chain []string
+	followed := map[string]bool{}
+	path := filepath.Clean(linkPath)
+	for {
+		info, err := os.Lstat(path)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return path, nil
+		}
+		chain = append(chain, rel(path))
+		if followed[path] {
+			return "", fmt.Errorf("Symlink cycle: %s", strings.Join(chain, " -> "))
+		}
+		followed[path] = true
+
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", fmt.Errorf("Error while reading symlink '%s': %v", path, err)
+		}
+		path = resolveSymlinkTarget(path, target)
+	}
+}
+
+// withinDir reports whether path is dir or lies beneath it.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// isSkippedDir reports whether the directory at rel has one of the names in
+// skipDirs. Entries containing a slash match the relative path instead.
+func isSkippedDir(rel string, skipDirs []string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, dir := range skipDirs {
+		dir = strings.Trim(filepath.ToSlash(dir), "/")
+		if strings.Contains(dir, "/") {
+			if rel == dir {
+				return true
 			}
+		} else if path.Base(rel) == dir {
+			return true
+		}
+	}
+	return false
+}
 
-			return nil
+func isExcluded(rel string, patterns []string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(filepath.ToSlash(pattern), "/")
+		if pattern == "" {
+			continue
 		}
-		return nil
-	})
-	return destDir, err
+		if rel == pattern || strings.HasPrefix(rel, pattern+"/") {
+			return true
+		}
+		if matched, _ := path.Match(pattern, rel); matched {
+			return true
+		}
+	}
+	return false
 }
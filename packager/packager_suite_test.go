@@ -2,11 +2,16 @@ package packager_test
 
 import (
 	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/cloudfoundry/libbuildpack"
 	"github.com/cloudfoundry/libbuildpack/packager"
 
 	. "github.com/onsi/ginkgo"
@@ -46,3 +51,23 @@ func ZipContents(zipFile, file string) (string, error) {
 	}
 	return "", fmt.Errorf("%s not found in %s", file, zipFile)
 }
+
+// LocalBuildpack copies fixture to a temporary directory and points its
+// rfc2324 dependency at a local file:// dependency with the given contents.
+func LocalBuildpack(fixture, contents string) (string, string) {
+	dir, err := ioutil.TempDir("", "bp_local")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(libbuildpack.CopyDirectory(fixture, dir)).To(Succeed())
+
+	depFile := filepath.Join(dir, "rfc2324.txt")
+	Expect(ioutil.WriteFile(depFile, []byte(contents), 0644)).To(Succeed())
+	sum := sha256.Sum256([]byte(contents))
+
+	manifestYml, err := ioutil.ReadFile(filepath.Join(dir, "manifest.yml"))
+	Expect(err).NotTo(HaveOccurred())
+	manifest := strings.Replace(string(manifestYml), "https://www.ietf.org/rfc/rfc2324.txt", "file://"+depFile, -1)
+	manifest = strings.Replace(manifest, "b11329c3fd6dbe9dddcb8dd90f18a4bf441858a6b5bfaccae5f91e5c7d2b3596", hex.EncodeToString(sum[:]), -1)
+	Expect(ioutil.WriteFile(filepath.Join(dir, "manifest.yml"), []byte(manifest), 0644)).To(Succeed())
+
+	return dir, depFile
+}
@@ -1,9 +1,16 @@
 package packager_test
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -231,6 +238,559 @@ var _ = Describe("Packager", func() {
 			})
 		})
 
+		Context("with options", func() {
+			var result packager.Result
+			BeforeEach(func() { cached = false })
+			JustBeforeEach(func() {
+				var err error
+				result, err = packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir: buildpackDir,
+					CacheDir:     cacheDir,
+					Version:      version,
+					Stack:        stack,
+					Cached:       cached,
+				})
+				Expect(err).To(BeNil())
+				zipFile = result.ZipFile
+			})
+
+			It("returns the size and sha256 of the zipfile", func() {
+				stat, err := os.Stat(zipFile)
+				Expect(err).To(BeNil())
+				Expect(result.Size).To(Equal(stat.Size()))
+
+				contents, err := ioutil.ReadFile(zipFile)
+				Expect(err).To(BeNil())
+				Expect(result.SHA256).To(Equal(fmt.Sprintf("%x", sha256.Sum256(contents))))
+			})
+
+			It("returns the included files", func() {
+				Expect(result.Files).To(Equal([]string{"manifest.yml", "VERSION", "bin/filename", "hi.txt"}))
+			})
+
+			It("describes the buildpack in the archive comment", func() {
+				result, err := packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir: buildpackDir,
+					CacheDir:     cacheDir,
+					Version:      "1.2.3",
+					Stack:        stack,
+					ZipComment:   true,
+				})
+				Expect(err).To(BeNil())
+
+				reader, err := zip.OpenReader(result.ZipFile)
+				Expect(err).To(BeNil())
+				defer reader.Close()
+				Expect(reader.Comment).To(HavePrefix("language: ruby\nversion: 1.2.3\nstack: cflinuxfs2\ncached: false\nbuilt: "))
+				Expect(os.Remove(result.ZipFile)).To(Succeed())
+			})
+
+			It("names the zip with the filename template", func() {
+				result, err := packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir:     buildpackDir,
+					CacheDir:         cacheDir,
+					Version:          "1.2.3",
+					Stack:            stack,
+					FilenameTemplate: "{language}-{version}-{stack}{{if .Cached}}-{cached}{{end}}.zip",
+				})
+				Expect(err).To(BeNil())
+				defer os.Remove(result.ZipFile)
+				Expect(filepath.Base(result.ZipFile)).To(Equal("ruby-1.2.3-cflinuxfs2.zip"))
+				Expect(result.ZipFile).To(BeARegularFile())
+			})
+
+			It("rejects a filename template that renders a path", func() {
+				_, err := packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir:     buildpackDir,
+					CacheDir:         cacheDir,
+					Version:          "1.2.3",
+					Stack:            stack,
+					FilenameTemplate: "../{language}.zip",
+				})
+				Expect(err).To(MatchError(`FilenameTemplate "../{language}.zip" renders "../ruby.zip", which is not a file name`))
+			})
+
+			It("writes a release summary next to the zip", func() {
+				result, err := packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir:   buildpackDir,
+					CacheDir:       cacheDir,
+					Version:        "1.2.3",
+					Stack:          stack,
+					ReleaseSummary: true,
+				})
+				Expect(err).To(BeNil())
+				defer os.Remove(result.ZipFile)
+				defer os.Remove(result.ReleaseSummaryFile)
+				Expect(result.ReleaseSummaryFile).To(Equal(result.ZipFile + ".json"))
+
+				data, err := ioutil.ReadFile(result.ReleaseSummaryFile)
+				Expect(err).To(BeNil())
+				var summary packager.ReleaseSummary
+				Expect(json.Unmarshal(data, &summary)).To(Succeed())
+				Expect(summary.Built).To(BeTemporally("~", time.Now(), time.Minute))
+				summary.Built = time.Time{}
+				Expect(summary).To(Equal(packager.ReleaseSummary{
+					Language: "ruby",
+					Version:  "1.2.3",
+					Stacks:   []string{"cflinuxfs2"},
+					Dependencies: []packager.ReleaseDependency{{
+						Name:    "ruby",
+						Version: "1.2.3",
+						URI:     "https://www.ietf.org/rfc/rfc2324.txt",
+						SHA256:  "b11329c3fd6dbe9dddcb8dd90f18a4bf441858a6b5bfaccae5f91e5c7d2b3596",
+					}},
+					SHA256: result.SHA256,
+				}))
+			})
+
+			It("adds extra files from memory", func() {
+				result, err := packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir: buildpackDir,
+					CacheDir:     cacheDir,
+					Version:      version,
+					Stack:        stack,
+					ExtraFiles:   []packager.ExtraFile{{Name: "BUILD_INFO.json", Contents: []byte(`{"builder":"ci"}`)}},
+				})
+				Expect(err).To(BeNil())
+				Expect(result.Files).To(ContainElement("BUILD_INFO.json"))
+				Expect(ZipContents(result.ZipFile, "BUILD_INFO.json")).To(Equal(`{"builder":"ci"}`))
+			})
+
+			It("returns the resolved dependencies", func() {
+				Expect(result.Dependencies).To(Equal([]packager.ResolvedDependency{{
+					Name:    "ruby",
+					Version: "1.2.3",
+					URI:     "https://www.ietf.org/rfc/rfc2324.txt",
+					SHA256:  "b11329c3fd6dbe9dddcb8dd90f18a4bf441858a6b5bfaccae5f91e5c7d2b3596",
+				}}))
+			})
+		})
+
+		Context("packaging to a writer", func() {
+			It("streams the zip and describes it", func() {
+				buffer := new(bytes.Buffer)
+				result, err := packager.PackageToWriter(packager.PackageOptions{
+					BuildpackDir: buildpackDir,
+					CacheDir:     cacheDir,
+					Version:      version,
+					Stack:        stack,
+				}, buffer)
+				Expect(err).To(BeNil())
+
+				Expect(result.ZipFile).To(BeEmpty())
+				Expect(result.Size).To(Equal(int64(buffer.Len())))
+				Expect(result.SHA256).To(Equal(fmt.Sprintf("%x", sha256.Sum256(buffer.Bytes()))))
+				Expect(result.Files).To(Equal([]string{"manifest.yml", "VERSION", "bin/filename", "hi.txt"}))
+
+				reader, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+				Expect(err).To(BeNil())
+				// bin/ has an entry of its own.
+				Expect(reader.File).To(HaveLen(5))
+			})
+
+			It("refuses to sign", func() {
+				_, err := packager.PackageToWriter(packager.PackageOptions{BuildpackDir: buildpackDir, SigningKey: "key.asc"}, new(bytes.Buffer))
+				Expect(err).To(MatchError("Cannot sign a buildpack packaged to a writer"))
+			})
+		})
+
+		Context("a logger is given", func() {
+			var buffer *bytes.Buffer
+			var logger *libbuildpack.Logger
+			BeforeEach(func() {
+				buffer = new(bytes.Buffer)
+				logger = libbuildpack.NewLogger(buffer)
+			})
+
+			It("writes pre_package failures to the logger", func() {
+				tempdir, err := ioutil.TempDir("", "bp_logger")
+				Expect(err).To(BeNil())
+				defer os.RemoveAll(tempdir)
+				Expect(libbuildpack.CopyDirectory(buildpackDir, tempdir)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(tempdir, "hi.sh"), []byte("#!/usr/bin/env bash\necho 'something broke'\nexit 1\n"), 0755)).To(Succeed())
+
+				_, err = packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir: tempdir,
+					CacheDir:     cacheDir,
+					Version:      version,
+					Stack:        stack,
+					Logger:       logger,
+				})
+				Expect(err).To(HaveOccurred())
+				Expect(buffer.String()).To(ContainSubstring("Failed to run pre_package ./hi.sh"))
+				Expect(buffer.String()).To(ContainSubstring("something broke"))
+			})
+		})
+
+		Context("pre_package", func() {
+			BeforeEach(func() {
+				tempdir, err := ioutil.TempDir("", "bp_pre_package")
+				Expect(err).To(BeNil())
+				Expect(libbuildpack.CopyDirectory(buildpackDir, tempdir)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(tempdir, "hi.sh"), []byte("#!/usr/bin/env bash\necho \"$BP_VERSION $BP_STACK $BP_CACHED $*\" > hi.txt\n"), 0755)).To(Succeed())
+
+				manifest, err := ioutil.ReadFile(filepath.Join(tempdir, "manifest.yml"))
+				Expect(err).To(BeNil())
+				manifest = append(manifest, []byte("pre_package_args: [one, two]\n")...)
+				Expect(ioutil.WriteFile(filepath.Join(tempdir, "manifest.yml"), manifest, 0644)).To(Succeed())
+				buildpackDir = tempdir
+			})
+			AfterEach(func() { os.RemoveAll(buildpackDir) })
+
+			It("streams its output and includes it in the error on failure", func() {
+				Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "hi.sh"), []byte("#!/usr/bin/env bash\necho working\necho 'something broke' >&2\nexit 3\n"), 0755)).To(Succeed())
+				stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+
+				_, err := packager.Packager{Stdout: stdout, Stderr: stderr, CacheDir: cacheDir}.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir: buildpackDir,
+					Version:      version,
+					Stack:        stack,
+				})
+				Expect(err).To(MatchError(HavePrefix("Failed to run pre_package ./hi.sh: exit status 3\n")))
+				Expect(err.Error()).To(ContainSubstring("working"))
+				Expect(err.Error()).To(ContainSubstring("something broke"))
+				Expect(stdout.String()).To(ContainSubstring("working\n"))
+				Expect(stderr.String()).To(Equal("something broke\n"))
+			})
+
+			It("kills the command and its children when it times out", func() {
+				survived := filepath.Join(buildpackDir, "survived")
+				Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "hi.sh"), []byte("#!/usr/bin/env bash\n(sleep 1; touch "+survived+") &\nsleep 30\n"), 0755)).To(Succeed())
+
+				start := time.Now()
+				_, err := packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir:      buildpackDir,
+					CacheDir:          cacheDir,
+					Version:           version,
+					Stack:             stack,
+					Logger:            libbuildpack.NewLogger(ioutil.Discard),
+					PrePackageTimeout: 200 * time.Millisecond,
+				})
+				Expect(err).To(MatchError(HavePrefix("Failed to run pre_package ./hi.sh: timed out after 200ms")))
+				Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+
+				Consistently(func() string { return survived }, 1500*time.Millisecond).ShouldNot(BeAnExistingFile())
+			})
+
+			It("stops when the overall timeout passes and leaves no zip behind", func() {
+				Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "hi.sh"), []byte("#!/usr/bin/env bash\nsleep 30\n"), 0755)).To(Succeed())
+
+				start := time.Now()
+				_, err := packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir: buildpackDir,
+					CacheDir:     cacheDir,
+					Version:      version,
+					Stack:        stack,
+					Logger:       libbuildpack.NewLogger(ioutil.Discard),
+					Timeout:      200 * time.Millisecond,
+				})
+				Expect(err).To(MatchError(HavePrefix("Packaging timed out after 200ms: Failed to run pre_package ./hi.sh: context deadline exceeded")))
+				Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+				Expect(filepath.Glob(filepath.Join(buildpackDir, "*.zip"))).To(BeEmpty())
+			})
+
+			It("stops when the context is cancelled", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				_, err := packager.PackageWithContext(ctx, packager.PackageOptions{
+					BuildpackDir: buildpackDir,
+					CacheDir:     cacheDir,
+					Version:      version,
+					Stack:        stack,
+					Logger:       libbuildpack.NewLogger(ioutil.Discard),
+				})
+				Expect(err).To(MatchError(ContainSubstring("context canceled")))
+				Expect(filepath.Glob(filepath.Join(buildpackDir, "*.zip"))).To(BeEmpty())
+			})
+
+			It("kills the command and its children when the context is cancelled while it runs", func() {
+				started := filepath.Join(buildpackDir, "started")
+				survived := filepath.Join(buildpackDir, "survived")
+				Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "hi.sh"), []byte("#!/usr/bin/env bash\n(sleep 1; touch "+survived+") &\ntouch "+started+"\nsleep 30\n"), 0755)).To(Succeed())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				done := make(chan error, 1)
+				go func() {
+					_, err := packager.PackageWithContext(ctx, packager.PackageOptions{
+						BuildpackDir: buildpackDir,
+						CacheDir:     cacheDir,
+						Version:      version,
+						Stack:        stack,
+						Logger:       libbuildpack.NewLogger(ioutil.Discard),
+					})
+					done <- err
+				}()
+
+				Eventually(func() string { return started }, 5*time.Second).Should(BeAnExistingFile())
+				cancel()
+				Eventually(done, 5*time.Second).Should(Receive(MatchError(ContainSubstring("context canceled"))))
+				Consistently(func() string { return survived }, 1500*time.Millisecond).ShouldNot(BeAnExistingFile())
+			})
+
+			It("is given the version, stack and cached flag and its arguments", func() {
+				zipFile, err = packager.Package(buildpackDir, cacheDir, "1.2.3", "cflinuxfs2", false)
+				Expect(err).To(BeNil())
+				Expect(ZipContents(zipFile, "hi.txt")).To(Equal("1.2.3 cflinuxfs2 false one two\n"))
+			})
+		})
+
+		Context("building incrementally", func() {
+			var options packager.PackageOptions
+			BeforeEach(func() {
+				tempdir, err := ioutil.TempDir("", "bp_incremental")
+				Expect(err).To(BeNil())
+				Expect(libbuildpack.CopyDirectory(buildpackDir, tempdir)).To(Succeed())
+				buildpackDir = tempdir
+				options = packager.PackageOptions{
+					BuildpackDir: buildpackDir,
+					CacheDir:     cacheDir,
+					Version:      version,
+					Stack:        stack,
+					Logger:       libbuildpack.NewLogger(ioutil.Discard),
+					Incremental:  true,
+				}
+			})
+			AfterEach(func() { os.RemoveAll(buildpackDir) })
+
+			build := func() packager.Result {
+				result, err := packager.PackageWithOptions(options)
+				Expect(err).To(BeNil())
+				zipFile = result.ZipFile
+				return result
+			}
+
+			It("leaves an up to date zip in place", func() {
+				first := build()
+				Expect(first.UpToDate).To(BeFalse())
+				Expect(first.ZipFile + ".inputs").To(BeAnExistingFile())
+
+				second := build()
+				Expect(second.UpToDate).To(BeTrue())
+				Expect(second.ZipFile).To(Equal(first.ZipFile))
+				Expect(second.SHA256).To(Equal(first.SHA256))
+				Expect(second.Dependencies).To(Equal(first.Dependencies))
+			})
+
+			It("rebuilds when an included file changes", func() {
+				build()
+				Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "bin", "filename"), []byte("changed"), 0755)).To(Succeed())
+
+				result := build()
+				Expect(result.UpToDate).To(BeFalse())
+				Expect(ZipContents(zipFile, "bin/filename")).To(Equal("changed"))
+			})
+
+			It("rebuilds when an included file's mode changes", func() {
+				build()
+				Expect(os.Chmod(filepath.Join(buildpackDir, "bin", "filename"), 0600)).To(Succeed())
+				Expect(build().UpToDate).To(BeFalse())
+			})
+
+			It("rebuilds when an option changing the zip does", func() {
+				build()
+				options.NormalizeModes = true
+				Expect(build().UpToDate).To(BeFalse())
+				options.ZipComment = true
+				Expect(build().UpToDate).To(BeFalse())
+				Expect(build().UpToDate).To(BeTrue())
+			})
+
+			It("does not leave an unsigned zip in place when asked to sign", func() {
+				build()
+				options.SigningKey = filepath.Join(buildpackDir, "key.asc")
+				Expect(ioutil.WriteFile(options.SigningKey, []byte("not a key"), 0600)).To(Succeed())
+
+				_, err := packager.PackageWithOptions(options)
+				Expect(err).To(MatchError(HavePrefix("Failed to import signing key " + options.SigningKey)))
+			})
+
+			It("rebuilds when forced to", func() {
+				build()
+				options.Force = true
+				Expect(build().UpToDate).To(BeFalse())
+			})
+		})
+
+		Context("CF_STACK is set", func() {
+			var oldStack string
+			BeforeEach(func() {
+				oldStack = os.Getenv("CF_STACK")
+				os.Setenv("CF_STACK", "some-other-stack")
+			})
+			AfterEach(func() { os.Setenv("CF_STACK", oldStack) })
+
+			It("validates the requested stack and leaves CF_STACK alone", func() {
+				zipFile, err = packager.Package(buildpackDir, cacheDir, version, "cflinuxfs3", false)
+				Expect(err).To(BeNil())
+				Expect(os.Getenv("CF_STACK")).To(Equal("some-other-stack"))
+			})
+		})
+
+		Context("no version is given", func() {
+			BeforeEach(func() {
+				tempdir, err := ioutil.TempDir("", "bp_version")
+				Expect(err).To(BeNil())
+				Expect(libbuildpack.CopyDirectory(buildpackDir, tempdir)).To(Succeed())
+				buildpackDir = tempdir
+			})
+			AfterEach(func() { os.RemoveAll(buildpackDir) })
+
+			It("uses the VERSION file", func() {
+				Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "VERSION"), []byte("4.5.6\n"), 0644)).To(Succeed())
+				zipFile, err = packager.Package(buildpackDir, cacheDir, "", stack, false)
+				Expect(err).To(BeNil())
+				Expect(filepath.Base(zipFile)).To(Equal("ruby_buildpack-cflinuxfs2-v4.5.6.zip"))
+				Expect(ZipContents(zipFile, "VERSION")).To(Equal("4.5.6\n"))
+			})
+
+			Context("with KeepVersionFile", func() {
+				packageKeeping := func(version string) (packager.Result, *bytes.Buffer, error) {
+					buffer := new(bytes.Buffer)
+					result, err := packager.PackageWithOptions(packager.PackageOptions{
+						BuildpackDir:    buildpackDir,
+						CacheDir:        cacheDir,
+						Version:         version,
+						Stack:           stack,
+						KeepVersionFile: true,
+						Logger:          libbuildpack.NewLogger(buffer),
+					})
+					zipFile = result.ZipFile
+					return result, buffer, err
+				}
+
+				It("packages the VERSION file and warns when the version differs", func() {
+					Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "VERSION"), []byte("4.5.6\n"), 0644)).To(Succeed())
+					_, buffer, err := packageKeeping("1.2.3")
+					Expect(err).To(BeNil())
+					Expect(filepath.Base(zipFile)).To(Equal("ruby_buildpack-cflinuxfs2-v4.5.6.zip"))
+					Expect(ZipContents(zipFile, "VERSION")).To(Equal("4.5.6\n"))
+					Expect(buffer.String()).To(ContainSubstring("Version 1.2.3 differs from the VERSION file, packaging 4.5.6"))
+				})
+
+				It("does not warn when the versions agree", func() {
+					Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "VERSION"), []byte("4.5.6\n"), 0644)).To(Succeed())
+					_, buffer, err := packageKeeping("4.5.6")
+					Expect(err).To(BeNil())
+					Expect(buffer.String()).NotTo(ContainSubstring("differs"))
+				})
+
+				It("writes the version when there is no VERSION file", func() {
+					Expect(os.Remove(filepath.Join(buildpackDir, "VERSION"))).To(Succeed())
+					_, _, err := packageKeeping("1.2.3")
+					Expect(err).To(BeNil())
+					Expect(ZipContents(zipFile, "VERSION")).To(Equal("1.2.3"))
+				})
+			})
+
+			It("fails without a VERSION file", func() {
+				Expect(os.Remove(filepath.Join(buildpackDir, "VERSION"))).To(Succeed())
+				_, err := packager.Package(buildpackDir, cacheDir, "", stack, false)
+				Expect(err).To(MatchError(HavePrefix("No version given and could not read VERSION file")))
+			})
+		})
+
+		Context("checking the version", func() {
+			packageVersion := func(version string, check packager.VersionCheck, logger *libbuildpack.Logger) error {
+				result, err := packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir: buildpackDir,
+					CacheDir:     cacheDir,
+					Version:      version,
+					Stack:        stack,
+					VersionCheck: check,
+					Logger:       logger,
+				})
+				zipFile = result.ZipFile
+				return err
+			}
+
+			It("accepts any version by default", func() {
+				Expect(packageVersion("20190101", packager.VersionCheckNone, nil)).To(Succeed())
+			})
+
+			It("rejects a version that is not a semantic version", func() {
+				Expect(packageVersion("v1.2", packager.VersionCheckStrict, nil)).To(MatchError(HavePrefix("Version `v1.2` is not a semantic version")))
+			})
+
+			It("accepts a semantic version", func() {
+				Expect(packageVersion("1.2.0", packager.VersionCheckStrict, nil)).To(Succeed())
+			})
+
+			It("warns about a version that is not a semantic version", func() {
+				buffer := new(bytes.Buffer)
+				Expect(packageVersion("1.2", packager.VersionCheckWarn, libbuildpack.NewLogger(buffer))).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("Version `1.2` is not a semantic version"))
+			})
+		})
+
+		Context("events are requested", func() {
+			var events *bytes.Buffer
+			BeforeEach(func() {
+				events = new(bytes.Buffer)
+				buildpackDir, _ = LocalBuildpack("./fixtures/good", "keaty")
+			})
+			AfterEach(func() { os.RemoveAll(buildpackDir) })
+
+			It("emits a JSON event per download, zipped file and on completion", func() {
+				result, err := packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir: buildpackDir,
+					CacheDir:     cacheDir,
+					Version:      version,
+					Stack:        stack,
+					Cached:       true,
+					Events:       events,
+				})
+				Expect(err).To(BeNil())
+				zipFile = result.ZipFile
+
+				var lines []packager.Event
+				decoder := json.NewDecoder(events)
+				for decoder.More() {
+					var event packager.Event
+					Expect(decoder.Decode(&event)).To(Succeed())
+					lines = append(lines, event)
+				}
+
+				Expect(lines[0]).To(Equal(packager.Event{Event: "download", Dep: "ruby", Bytes: 5}))
+				Expect(lines[1]).To(Equal(packager.Event{Event: "zip", File: "VERSION"}))
+				Expect(lines).To(HaveLen(len(result.Files) + 2))
+				Expect(lines[len(lines)-1]).To(Equal(packager.Event{Event: "done", Zip: result.ZipFile, SHA256: result.SHA256}))
+			})
+		})
+
+		Context("using a Packager", func() {
+			It("writes to its own output instead of the package-level Stdout", func() {
+				tempdir, err := ioutil.TempDir("", "bp_packager")
+				Expect(err).To(BeNil())
+				defer os.RemoveAll(tempdir)
+				Expect(libbuildpack.CopyDirectory(buildpackDir, tempdir)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(tempdir, "hi.sh"), []byte("#!/usr/bin/env bash\necho 'something broke'\nexit 1\n"), 0755)).To(Succeed())
+
+				output := new(bytes.Buffer)
+				p := packager.Packager{Stdout: output, Stderr: output, CacheDir: cacheDir}
+				_, err = p.Package(tempdir, "", version, stack, false)
+				Expect(err).To(HaveOccurred())
+
+				Expect(output.String()).To(ContainSubstring("something broke"))
+			})
+
+			It("accepts writers that cannot be compared", func() {
+				tempdir, err := ioutil.TempDir("", "bp_packager")
+				Expect(err).To(BeNil())
+				defer os.RemoveAll(tempdir)
+				Expect(libbuildpack.CopyDirectory(buildpackDir, tempdir)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(tempdir, "hi.sh"), []byte("#!/usr/bin/env bash\necho 'to stdout'\necho 'to stderr' >&2\nexit 1\n"), 0755)).To(Succeed())
+
+				output := new(bytes.Buffer)
+				p := packager.Packager{Stdout: uncomparableWriter{buf: output}, Stderr: uncomparableWriter{buf: output}, CacheDir: cacheDir}
+				_, err = p.Package(tempdir, "", version, stack, false)
+				Expect(err).To(MatchError(ContainSubstring("to stderr")))
+
+				Expect(output.String()).To(ContainSubstring("to stdout"))
+				Expect(output.String()).To(ContainSubstring("to stderr"))
+			})
+		})
+
 		Context("manifest.yml was already packaged", func() {
 			Context("setting specific stack", func() {
 				BeforeEach(func() { stack = "cflinuxfs2" })
@@ -251,6 +811,77 @@ var _ = Describe("Packager", func() {
 			})
 		})
 
+		Context("default versions differ by stack", func() {
+			packagedManifest := func(stack string) map[string]interface{} {
+				zipFile, err := packager.Package("./fixtures/stack_defaults", cacheDir, version, stack, false)
+				Expect(err).To(BeNil())
+				defer os.Remove(zipFile)
+
+				manifestYml, err := ZipContents(zipFile, "manifest.yml")
+				Expect(err).To(BeNil())
+				var m map[string]interface{}
+				Expect(yaml.Unmarshal([]byte(manifestYml), &m)).To(Succeed())
+				return m
+			}
+
+			It("keeps only the defaults for the stack packaged for", func() {
+				Expect(packagedManifest("cflinuxfs3")["default_versions"]).To(Equal([]interface{}{
+					map[interface{}]interface{}{"name": "ruby", "version": "2.7.x"},
+					map[interface{}]interface{}{"name": "bundler", "version": "1.x"},
+				}))
+			})
+
+			It("resolves the default for the stack at staging", func() {
+				bpDir, err := ioutil.TempDir("", "packaged")
+				Expect(err).To(BeNil())
+				defer os.RemoveAll(bpDir)
+				manifestYml, err := yaml.Marshal(packagedManifest("cflinuxfs3"))
+				Expect(err).To(BeNil())
+				Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), manifestYml, 0644)).To(Succeed())
+
+				oldStack, hadStack := os.LookupEnv("CF_STACK")
+				Expect(os.Setenv("CF_STACK", "cflinuxfs3")).To(Succeed())
+				defer func() {
+					if hadStack {
+						os.Setenv("CF_STACK", oldStack)
+					} else {
+						os.Unsetenv("CF_STACK")
+					}
+				}()
+
+				manifest, err := libbuildpack.NewManifest(bpDir, libbuildpack.NewLogger(ioutil.Discard), time.Now())
+				Expect(err).To(BeNil())
+				Expect(manifest.DefaultVersion("ruby")).To(Equal(libbuildpack.Dependency{Name: "ruby", Version: "2.7.1"}))
+			})
+
+			It("refuses to package for any stack", func() {
+				_, err := packager.Package("./fixtures/stack_defaults", cacheDir, version, "", false)
+				Expect(err).To(MatchError("Default version of `ruby` is scoped to stacks cflinuxfs2, so the buildpack must be packaged for a stack"))
+			})
+		})
+
+		Context("reporting the packaged stacks", func() {
+			packageFor := func(stack string) []string {
+				result, err := packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir: buildpackDir,
+					CacheDir:     cacheDir,
+					Version:      version,
+					Stack:        stack,
+				})
+				Expect(err).To(BeNil())
+				defer os.Remove(result.ZipFile)
+				return result.Stacks
+			}
+
+			It("lists the stacks of the packaged dependencies for any stack", func() {
+				Expect(packageFor("")).To(Equal([]string{"cflinuxfs2", "cflinuxfs3"}))
+			})
+
+			It("lists just the stack packaged for", func() {
+				Expect(packageFor("cflinuxfs3")).To(Equal([]string{"cflinuxfs3"}))
+			})
+		})
+
 		Context("manifest.yml has no dependencies", func() {
 			BeforeEach(func() { stack = "cflinuxfs2" })
 
@@ -258,6 +889,23 @@ var _ = Describe("Packager", func() {
 				zipFile, err = packager.Package("./fixtures/no_dependencies", cacheDir, version, stack, cached)
 				Expect(err).To(BeNil())
 			})
+
+			It("packages just the include files when the dependencies key is left out", func() {
+				for _, cached := range []bool{false, true} {
+					zipFile, err = packager.Package("./fixtures/without_dependencies", cacheDir, version, stack, cached)
+					Expect(err).To(BeNil())
+					defer os.Remove(zipFile)
+
+					entries, err := packager.ListZipContents(zipFile)
+					Expect(err).To(BeNil())
+					var names []string
+					for _, entry := range entries {
+						names = append(names, entry.Name)
+					}
+					Expect(names).To(Equal([]string{"README.md", "VERSION", "manifest.yml"}))
+					Expect(ZipContents(zipFile, "manifest.yml")).To(ContainSubstring("dependencies: []"))
+				}
+			})
 		})
 
 		Context("stack is invalid", func() {
@@ -267,6 +915,7 @@ var _ = Describe("Packager", func() {
 				It("returns an error", func() {
 					zipFile, err = packager.Package(buildpackDir, cacheDir, version, stack, cached)
 					Expect(err).To(MatchError("Stack `nonexistent-stack` not found in manifest"))
+					Expect(errors.As(err, &packager.StackNotFoundError{})).To(BeTrue())
 				})
 			})
 			Context("stack not found in any default dependencies", func() {
@@ -327,6 +976,67 @@ var _ = Describe("Packager", func() {
 			})
 		})
 
+		Context("when include_files lists directories", func() {
+			BeforeEach(func() {
+				cached = false
+				buildpackDir = "./fixtures/symlink_dir"
+			})
+
+			It("adds them as directory entries", func() {
+				zipFile, err = packager.Package(buildpackDir, cacheDir, version, stack, cached)
+				Expect(err).To(BeNil())
+
+				Expect(ZipContents(zipFile, "random_dir/")).To(Equal(""))
+				Expect(ZipContents(zipFile, "sym_dir/")).To(Equal(""))
+			})
+
+			It("includes everything beneath them", func() {
+				zipFile, err = packager.Package(buildpackDir, cacheDir, version, stack, cached)
+				Expect(err).To(BeNil())
+
+				Expect(ZipContents(zipFile, "random_dir/.gitkeep")).To(Equal(""))
+			})
+		})
+
+		Context("when include_files lists a directory tree", func() {
+			BeforeEach(func() {
+				var err error
+				buildpackDir, err = ioutil.TempDir("", "bp_tree")
+				Expect(err).To(BeNil())
+				Expect(libbuildpack.CopyDirectory("./fixtures/good", buildpackDir)).To(Succeed())
+
+				Expect(os.MkdirAll(filepath.Join(buildpackDir, "lib", "x", "y"), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "lib", "a.sh"), []byte("a"), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "lib", "x", "y", "b.txt"), []byte("b"), 0644)).To(Succeed())
+
+				manifestYml, err := ioutil.ReadFile(filepath.Join(buildpackDir, "manifest.yml"))
+				Expect(err).To(BeNil())
+				manifestYml = []byte(strings.Replace(string(manifestYml), "- bin/filename\n", "- bin/filename\n- lib/\n", 1))
+				Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "manifest.yml"), manifestYml, 0644)).To(Succeed())
+			})
+			AfterEach(func() { os.RemoveAll(buildpackDir) })
+
+			It("includes it recursively with relative names and modes", func() {
+				result, err := packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir: buildpackDir,
+					CacheDir:     cacheDir,
+					Version:      version,
+					Stack:        stack,
+				})
+				Expect(err).To(BeNil())
+				zipFile = result.ZipFile
+
+				Expect(result.Files).To(ContainElements("lib", "lib/a.sh", "lib/x", "lib/x/y", "lib/x/y/b.txt"))
+				entries, err := packager.ListZipContents(zipFile)
+				Expect(err).To(BeNil())
+				Expect(entries).To(ContainElements(
+					packager.ZipEntry{Name: "lib/", Mode: os.ModeDir | 0755},
+					packager.ZipEntry{Name: "lib/a.sh", Size: 1, Mode: 0755},
+					packager.ZipEntry{Name: "lib/x/y/b.txt", Size: 1, Mode: 0644},
+				))
+			})
+		})
+
 		Context("cached dependency has wrong md5", func() {
 			BeforeEach(func() {
 				cached = true
@@ -357,11 +1067,509 @@ var _ = Describe("Packager", func() {
 			})
 		})
 
+		Context("include_files contains glob patterns", func() {
+			BeforeEach(func() {
+				var err error
+				buildpackDir, err = ioutil.TempDir("", "bp_globs")
+				Expect(err).To(BeNil())
+				Expect(libbuildpack.CopyDirectory("./fixtures/good", buildpackDir)).To(Succeed())
+
+				for _, name := range []string{"lib/a.so", "lib/x/y/b.so", "lib/x/c.txt"} {
+					Expect(os.MkdirAll(filepath.Join(buildpackDir, filepath.Dir(name)), 0755)).To(Succeed())
+					Expect(ioutil.WriteFile(filepath.Join(buildpackDir, name), []byte(name), 0644)).To(Succeed())
+				}
+
+				manifestYml, err := ioutil.ReadFile(filepath.Join(buildpackDir, "manifest.yml"))
+				Expect(err).To(BeNil())
+				manifestYml = []byte(strings.Replace(string(manifestYml), "- bin/filename\n", "- bin/*\n- bin/filename\n- lib/**/*.so\n", 1))
+				Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "manifest.yml"), manifestYml, 0644)).To(Succeed())
+			})
+			AfterEach(func() { os.RemoveAll(buildpackDir) })
+
+			It("includes each matching file once", func() {
+				result, err := packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir: buildpackDir,
+					CacheDir:     cacheDir,
+					Version:      version,
+					Stack:        stack,
+				})
+				Expect(err).To(BeNil())
+				zipFile = result.ZipFile
+
+				Expect(result.Files).To(Equal([]string{"manifest.yml", "VERSION", "bin/filename", "bin/ignoredfile", "lib/a.so", "lib/x/y/b.so", "hi.txt"}))
+				Expect(ZipContents(zipFile, "lib/x/y/b.so")).To(Equal("lib/x/y/b.so"))
+				_, err = ZipContents(zipFile, "lib/x/c.txt")
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("packaging include_files in a skipped directory", func() {
+			BeforeEach(func() {
+				tempdir, err := ioutil.TempDir("", "bp_skipped_include")
+				Expect(err).To(BeNil())
+				Expect(libbuildpack.CopyDirectory(buildpackDir, tempdir)).To(Succeed())
+				Expect(os.MkdirAll(filepath.Join(tempdir, "tests"), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(tempdir, "tests", "foo"), []byte("fixture"), 0644)).To(Succeed())
+
+				manifest, err := ioutil.ReadFile(filepath.Join(tempdir, "manifest.yml"))
+				Expect(err).To(BeNil())
+				manifest = []byte(strings.Replace(string(manifest), "include_files:\n", "include_files:\n- tests/foo\n", 1))
+				Expect(ioutil.WriteFile(filepath.Join(tempdir, "manifest.yml"), manifest, 0644)).To(Succeed())
+				buildpackDir = tempdir
+			})
+			AfterEach(func() { os.RemoveAll(buildpackDir) })
+
+			It("returns an error rather than leaving them out", func() {
+				_, err := packager.Package(buildpackDir, cacheDir, version, stack, false)
+				Expect(err).To(MatchError("IncludeFiles references tests/foo but tests is skipped"))
+			})
+
+			It("packages them when the directory is not skipped", func() {
+				result, err := packager.PackageWithOptions(packager.PackageOptions{
+					BuildpackDir: buildpackDir,
+					CacheDir:     cacheDir,
+					Version:      version,
+					Stack:        stack,
+					SkipDirs:     []string{".git"},
+				})
+				Expect(err).To(BeNil())
+				Expect(ZipContents(result.ZipFile, "tests/foo")).To(Equal("fixture"))
+			})
+		})
+
 		Context("packaging with missing included_files", func() {
 			It("returns an error", func() {
 				zipFile, err = packager.Package("./fixtures/missing_included_files", cacheDir, version, stack, cached)
-				Expect(err).To(MatchError(MatchRegexp("failed to open included_file: .*/DOESNOTEXIST.txt")))
+				Expect(err).To(MatchError("include_files not found in buildpack: DOESNOTEXIST.txt"))
+			})
+		})
+	})
+
+	Describe("ManifestJSON", func() {
+		packageJSON := func() (packager.Result, string) {
+			result, err := packager.PackageWithOptions(packager.PackageOptions{
+				BuildpackDir: buildpackDir,
+				CacheDir:     cacheDir,
+				Version:      version,
+				Stack:        stack,
+				ManifestJSON: true,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(result.ZipFile)
+			contents, err := ZipContents(result.ZipFile, "manifest.json")
+			Expect(err).NotTo(HaveOccurred())
+			return result, contents
+		}
+
+		It("adds the packaged manifest as JSON", func() {
+			result, contents := packageJSON()
+			Expect(result.Files).To(ContainElement("manifest.json"))
+
+			var manifest map[string]interface{}
+			Expect(json.Unmarshal([]byte(contents), &manifest)).To(Succeed())
+			Expect(manifest["language"]).To(Equal("ruby"))
+			Expect(manifest["stack"]).To(Equal(stack))
+			Expect(manifest["dependencies"]).NotTo(BeEmpty())
+			for _, dep := range manifest["dependencies"].([]interface{}) {
+				Expect(dep).NotTo(HaveKey("cf_stacks"))
+			}
+		})
+
+		It("encodes the manifest the same way every time", func() {
+			_, first := packageJSON()
+			_, second := packageJSON()
+			Expect(second).To(Equal(first))
+		})
+	})
+
+	Describe("TransformManifest", func() {
+		packageWith := func(transform func(map[string]interface{}) error) (string, error) {
+			result, err := packager.PackageWithOptions(packager.PackageOptions{
+				BuildpackDir:      buildpackDir,
+				CacheDir:          cacheDir,
+				Version:           version,
+				Stack:             stack,
+				TransformManifest: transform,
+			})
+			return result.ZipFile, err
+		}
+
+		It("writes the manifest as the hook leaves it", func() {
+			zipFile, err := packageWith(func(m map[string]interface{}) error {
+				Expect(m["stack"]).To(Equal(stack))
+				m["build_info"] = map[string]interface{}{"builder": "ci"}
+				delete(m, "pre_package")
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(zipFile)
+
+			manifestYml, err := ZipContents(zipFile, "manifest.yml")
+			Expect(err).NotTo(HaveOccurred())
+			var m map[string]interface{}
+			Expect(yaml.Unmarshal([]byte(manifestYml), &m)).To(Succeed())
+			Expect(m["build_info"]).To(Equal(map[interface{}]interface{}{"builder": "ci"}))
+			Expect(m).NotTo(HaveKey("pre_package"))
+		})
+
+		It("fails packaging when the hook fails", func() {
+			_, err := packageWith(func(map[string]interface{}) error { return errors.New("no build_info") })
+			Expect(err).To(MatchError("Failed to transform manifest: no build_info"))
+		})
+	})
+
+	Describe("ZipFileName", func() {
+		It("names the zip the way Package does", func() {
+			Expect(packager.ZipFileName("ruby", "1.2.3", "cflinuxfs3", false)).To(Equal("ruby_buildpack-cflinuxfs3-v1.2.3.zip"))
+			Expect(packager.ZipFileName("ruby", "1.2.3", "cflinuxfs3", true)).To(Equal("ruby_buildpack-cached-cflinuxfs3-v1.2.3.zip"))
+			Expect(packager.ZipFileName("ruby", "1.2.3", "", true)).To(Equal("ruby_buildpack-cached-v1.2.3.zip"))
+		})
+
+		It("matches the zip Package writes", func() {
+			zipFile, err := packager.Package(buildpackDir, cacheDir, version, stack, false)
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(zipFile)
+			Expect(filepath.Base(zipFile)).To(Equal(packager.ZipFileName("ruby", version, stack, false)))
+		})
+	})
+
+	Describe("CopyDirectoryWithOptions", func() {
+		var srcDir, destDir string
+
+		BeforeEach(func() {
+			var err error
+			srcDir, err = ioutil.TempDir("", "packager-copy-src")
+			Expect(err).To(BeNil())
+
+			for _, name := range []string{
+				"manifest.yml",
+				".git/config",
+				".github/workflows/test.yml",
+				"tests/unit_test.go",
+				"vendor/fixtures/big.tgz",
+				"vendor/lib/keep.go",
+				"spec/a/b/c_spec.rb",
+				"docs/README.md",
+				"docs/notes.txt",
+			} {
+				Expect(os.MkdirAll(filepath.Join(srcDir, filepath.Dir(name)), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(srcDir, name), []byte(name), 0644)).To(Succeed())
+			}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(srcDir)
+			os.RemoveAll(destDir)
+		})
+
+		copied := func(name string) bool {
+			_, err := os.Lstat(filepath.Join(destDir, name))
+			return err == nil
+		}
+
+		It("creates the copy in the given temp directory", func() {
+			tempRoot, err := ioutil.TempDir("", "packager-copy-root")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(tempRoot)
+
+			destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{TempDir: tempRoot})
+			Expect(err).To(BeNil())
+			Expect(filepath.Dir(destDir)).To(Equal(tempRoot))
+			Expect(copied("manifest.yml")).To(BeTrue())
+		})
+
+		It("always skips .git and tests", func() {
+			var err error
+			destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{})
+			Expect(err).To(BeNil())
+
+			Expect(copied("manifest.yml")).To(BeTrue())
+			Expect(copied(".github/workflows/test.yml")).To(BeTrue())
+			Expect(copied(".git")).To(BeFalse())
+			Expect(copied("tests")).To(BeFalse())
+		})
+
+		Context("SkipDirs", func() {
+			BeforeEach(func() {
+				Expect(os.MkdirAll(filepath.Join(srcDir, "src/app/tests"), 0755)).To(Succeed())
+				Expect(os.MkdirAll(filepath.Join(srcDir, "src/app/.idea"), 0755)).To(Succeed())
+				Expect(os.MkdirAll(filepath.Join(srcDir, "node_modules/x"), 0755)).To(Succeed())
+			})
+
+			It("skips the default directories wherever they occur", func() {
+				var err error
+				destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{})
+				Expect(err).To(BeNil())
+
+				Expect(copied("tests")).To(BeFalse())
+				Expect(copied("src/app/tests")).To(BeFalse())
+				Expect(copied("src/app/.idea")).To(BeTrue())
+			})
+
+			It("replaces the defaults when given", func() {
+				var err error
+				destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{SkipDirs: []string{".idea", "node_modules"}})
+				Expect(err).To(BeNil())
+
+				Expect(copied("tests/unit_test.go")).To(BeTrue())
+				Expect(copied("src/app/tests")).To(BeTrue())
+				Expect(copied("src/app/.idea")).To(BeFalse())
+				Expect(copied("node_modules")).To(BeFalse())
+				Expect(copied(".git/config")).To(BeTrue())
+			})
+
+			It("copies everything when empty", func() {
+				var err error
+				destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{SkipDirs: []string{}})
+				Expect(err).To(BeNil())
+
+				Expect(copied(".git/config")).To(BeTrue())
+				Expect(copied("tests/unit_test.go")).To(BeTrue())
 			})
 		})
+
+		Context("the tree contains symlinks", func() {
+			BeforeEach(func() {
+				Expect(os.Symlink("../manifest.yml", filepath.Join(srcDir, "docs/manifest.yml"))).To(Succeed())
+				Expect(os.Symlink(filepath.Join(srcDir, "docs"), filepath.Join(srcDir, "absolute-docs"))).To(Succeed())
+			})
+
+			It("copies links that stay inside the tree", func() {
+				var err error
+				destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{})
+				Expect(err).To(BeNil())
+
+				Expect(os.Readlink(filepath.Join(destDir, "docs/manifest.yml"))).To(Equal("../manifest.yml"))
+				Expect(copied("absolute-docs")).To(BeTrue())
+			})
+
+			Context("a link escapes the tree", func() {
+				BeforeEach(func() {
+					Expect(os.Symlink("../../../../etc/passwd", filepath.Join(srcDir, "docs/passwd"))).To(Succeed())
+				})
+
+				It("returns an error", func() {
+					var err error
+					destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{})
+					Expect(err).To(MatchError(ContainSubstring("Symlink 'docs/passwd' points to '../../../../etc/passwd', which is outside of")))
+				})
+
+				It("copies it when external symlinks are allowed", func() {
+					var err error
+					destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{AllowExternalSymlinks: true})
+					Expect(err).To(BeNil())
+					Expect(os.Readlink(filepath.Join(destDir, "docs/passwd"))).To(Equal("../../../../etc/passwd"))
+				})
+
+				It("returns an error for a link inside the tree leading to it", func() {
+					Expect(os.Symlink("docs/passwd", filepath.Join(srcDir, "passwd"))).To(Succeed())
+					Expect(os.Remove(filepath.Join(srcDir, "docs/passwd"))).To(Succeed())
+					Expect(os.Symlink("/etc/passwd", filepath.Join(srcDir, "docs/passwd"))).To(Succeed())
+
+					var err error
+					destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{Exclude: []string{"docs/passwd"}})
+					Expect(err).To(MatchError(ContainSubstring("Symlink 'passwd' points to 'docs/passwd', which is outside of")))
+				})
+			})
+
+			It("returns an error naming a cycle of links", func() {
+				var err error
+				destDir, err = packager.CopyDirectoryWithOptions("./fixtures/symlink_cycle", packager.CopyOptions{})
+				Expect(err).To(MatchError("Symlink cycle: a -> b -> a"))
+			})
+		})
+
+		It("skips excluded paths and everything beneath them", func() {
+			var err error
+			destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{
+				Exclude: []string{".github", "vendor/fixtures", "spec/"},
+			})
+			Expect(err).To(BeNil())
+
+			Expect(copied(".github")).To(BeFalse())
+			Expect(copied("vendor/fixtures")).To(BeFalse())
+			Expect(copied("vendor/lib/keep.go")).To(BeTrue())
+			Expect(copied("spec")).To(BeFalse())
+			Expect(copied("manifest.yml")).To(BeTrue())
+			Expect(copied(".git")).To(BeFalse())
+		})
+
+		Context("a .buildpackignore file is present", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(filepath.Join(srcDir, ".buildpackignore"), []byte(`# comment
+*.md
+!docs/README.md
+vendor/
+/spec/**/b
+spec_helper.rb
+tests
+`), 0644)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(srcDir, "CHANGELOG.md"), []byte("changes"), 0644)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(srcDir, "spec/a/spec_helper.rb"), []byte("helper"), 0644)).To(Succeed())
+			})
+
+			It("skips matching paths", func() {
+				var err error
+				destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{})
+				Expect(err).To(BeNil())
+
+				Expect(copied("CHANGELOG.md")).To(BeFalse())
+				Expect(copied("vendor")).To(BeFalse())
+				Expect(copied("spec/a")).To(BeTrue())
+				Expect(copied("spec/a/b")).To(BeFalse())
+				Expect(copied("spec/a/spec_helper.rb")).To(BeFalse())
+				Expect(copied("docs/notes.txt")).To(BeTrue())
+				Expect(copied("manifest.yml")).To(BeTrue())
+			})
+
+			It("re-includes negated paths", func() {
+				var err error
+				destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{})
+				Expect(err).To(BeNil())
+
+				Expect(copied("docs/README.md")).To(BeTrue())
+			})
+
+			It("still skips .git and tests", func() {
+				var err error
+				destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{})
+				Expect(err).To(BeNil())
+
+				Expect(copied(".git")).To(BeFalse())
+				Expect(copied("tests")).To(BeFalse())
+			})
+		})
+
+		It("preserves modification times", func() {
+			mtime := time.Date(2015, 10, 21, 16, 29, 0, 0, time.UTC)
+			Expect(os.Chtimes(filepath.Join(srcDir, "docs/notes.txt"), mtime, mtime)).To(Succeed())
+			Expect(os.Chtimes(filepath.Join(srcDir, "docs"), mtime, mtime)).To(Succeed())
+
+			var err error
+			destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{})
+			Expect(err).To(BeNil())
+
+			for _, name := range []string{"docs/notes.txt", "docs"} {
+				info, err := os.Stat(filepath.Join(destDir, name))
+				Expect(err).To(BeNil())
+				Expect(info.ModTime().Equal(mtime)).To(BeTrue(), name)
+			}
+		})
+
+		Context("with a socket in the tree", func() {
+			var listener net.Listener
+			BeforeEach(func() {
+				var err error
+				listener, err = net.Listen("unix", filepath.Join(srcDir, "docs", "app.sock"))
+				if err != nil {
+					Skip("unix sockets are not supported: " + err.Error())
+				}
+			})
+			AfterEach(func() {
+				if listener != nil {
+					listener.Close()
+				}
+			})
+
+			It("skips it with a warning", func() {
+				buffer := new(bytes.Buffer)
+				var err error
+				destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{Logger: libbuildpack.NewLogger(buffer)})
+				Expect(err).To(BeNil())
+				Expect(copied("docs/app.sock")).To(BeFalse())
+				Expect(copied("docs/notes.txt")).To(BeTrue())
+				Expect(buffer.String()).To(ContainSubstring("Skipping '" + filepath.Join("docs", "app.sock") + "', which is a socket"))
+			})
+
+			It("fails when special files are rejected", func() {
+				var err error
+				destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{RejectSpecialFiles: true})
+				Expect(err).To(MatchError("Cannot copy '" + filepath.Join("docs", "app.sock") + "', which is a socket"))
+			})
+		})
+
+		It("skips paths matching glob patterns", func() {
+			var err error
+			destDir, err = packager.CopyDirectoryWithOptions(srcDir, packager.CopyOptions{
+				Exclude: []string{"docs/*.md", "spec/*/b"},
+			})
+			Expect(err).To(BeNil())
+
+			Expect(copied("docs/README.md")).To(BeFalse())
+			Expect(copied("docs/notes.txt")).To(BeTrue())
+			Expect(copied("spec/a")).To(BeTrue())
+			Expect(copied("spec/a/b")).To(BeFalse())
+		})
+	})
+
+	Describe("CompileExtensionPackageWithOptions", func() {
+		var bpDir, script, extensionStack string
+
+		BeforeEach(func() {
+			extensionStack = "cflinuxfs2"
+			var err error
+			bpDir, err = ioutil.TempDir("", "packager-extension")
+			Expect(err).To(BeNil())
+			Expect(libbuildpack.CopyDirectory("./fixtures/good", bpDir)).To(Succeed())
+			script = filepath.Join(bpDir, "fake-packager")
+		})
+
+		AfterEach(func() { os.RemoveAll(bpDir) })
+
+		compile := func(ctx context.Context, body string, gemfile string) (string, error) {
+			Expect(ioutil.WriteFile(script, []byte("#!/bin/sh\n"+body), 0755)).To(Succeed())
+			return packager.Packager{Stdout: ioutil.Discard, Stderr: ioutil.Discard}.CompileExtensionPackageWithOptions(ctx, packager.ExtensionOptions{
+				BuildpackDir: bpDir,
+				Version:      "1.0.0",
+				Cached:       true,
+				Stack:        extensionStack,
+				Command:      []string{script, "--verbose"},
+				Gemfile:      gemfile,
+			})
+		}
+
+		It("runs the given command with the gemfile", func() {
+			zipFile, err := compile(context.Background(), `echo "$BUNDLE_GEMFILE $*" > ruby_buildpack-cached-cflinuxfs2-v1.0.0.zip`, "Other.Gemfile")
+			Expect(err).To(BeNil())
+
+			Expect(zipFile).To(Equal(filepath.Join(bpDir, "ruby_buildpack-cached-cflinuxfs2-v1.0.0.zip")))
+			Expect(ioutil.ReadFile(zipFile)).To(Equal([]byte("Other.Gemfile --verbose --cached --stack=cflinuxfs2\n")))
+		})
+
+		It("leaves the stack out of the name of an any-stack zip", func() {
+			extensionStack = "any"
+			zipFile, err := compile(context.Background(), `echo "$*" > ruby_buildpack-cached-v1.0.0.zip`, "")
+			Expect(err).To(BeNil())
+
+			Expect(zipFile).To(Equal(filepath.Join(bpDir, "ruby_buildpack-cached-v1.0.0.zip")))
+			Expect(ioutil.ReadFile(zipFile)).To(Equal([]byte("--verbose --cached --any-stack\n")))
+		})
+
+		It("removes the copy it packaged in", func() {
+			_, err := compile(context.Background(), "pwd > \"$0.dir\"; touch ruby_buildpack-cached-cflinuxfs2-v1.0.0.zip", "")
+			Expect(err).To(BeNil())
+
+			dir, err := ioutil.ReadFile(filepath.Join(bpDir, "fake-packager.dir"))
+			Expect(err).To(BeNil())
+			Expect(strings.TrimSpace(string(dir))).NotTo(BeADirectory())
+		})
+
+		It("kills the command when the context is cancelled", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			_, err := compile(ctx, "sleep 30\n", "")
+			Expect(err).To(MatchError(ContainSubstring("context deadline exceeded")))
+			Expect(time.Since(start)).To(BeNumerically("<", 10*time.Second))
+		})
 	})
 })
+
+// uncomparableWriter panics when compared with ==, since it holds a slice.
+type uncomparableWriter struct {
+	buf   *bytes.Buffer
+	notes []string
+}
+
+func (w uncomparableWriter) Write(b []byte) (int, error) { return w.buf.Write(b) }
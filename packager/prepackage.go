@@ -0,0 +1,113 @@
+package packager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// DefaultPrePackageTimeout bounds the pre_package command unless
+// PackageOptions.PrePackageTimeout says otherwise.
+const DefaultPrePackageTimeout = 5 * time.Minute
+
+// prePackageOutputTail is how much of the pre_package command's output is
+// kept for the error returned when it fails.
+const prePackageOutputTail = 8 * 1024
+
+// prePackageEnv is the environment of the pre_package command: the
+// packager's own environment plus BP_VERSION, BP_STACK (empty when packaging
+// for any stack) and BP_CACHED ("true" or "false").
+func prePackageEnv(version, stack string, cached bool) []string {
+	return append(os.Environ(),
+		"BP_VERSION="+version,
+		"BP_STACK="+stack,
+		fmt.Sprintf("BP_CACHED=%t", cached),
+	)
+}
+
+// runPrePackage runs the manifest's pre_package command in dir, streaming
+// its output to stdout and stderr as it runs, or only to stdout when
+// combined is set. On failure the end of the output is returned along with
+// the error.
+//
+// When timeout is positive and the command runs for longer, its whole
+// process group is killed so that no children are left behind.
+func runPrePackage(ctx context.Context, manifest Manifest, dir string, env []string, stdout, stderr io.Writer, combined bool, timeout time.Duration) (string, error) {
+	parent := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, manifest.PrePackage, manifest.PrePackageArgs...)
+	cmd.Dir = dir
+	cmd.Env = env
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcessGroup(cmd) }
+	// Stop waiting for output from children that escaped the process group.
+	cmd.WaitDelay = time.Second
+
+	tail := &tailWriter{max: prePackageOutputTail}
+	if combined {
+		// A single writer keeps stdout and stderr interleaved in order.
+		cmd.Stdout = io.MultiWriter(stdout, tail)
+		cmd.Stderr = cmd.Stdout
+	} else {
+		// stdout and stderr are copied concurrently and may still be the
+		// same writer, so writes to them take turns.
+		var mutex sync.Mutex
+		cmd.Stdout = &turnWriter{mutex: &mutex, w: io.MultiWriter(stdout, tail)}
+		cmd.Stderr = &turnWriter{mutex: &mutex, w: io.MultiWriter(stderr, tail)}
+	}
+
+	if err := cmd.Run(); err != nil {
+		if parent.Err() != nil {
+			return tail.String(), parent.Err()
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return tail.String(), fmt.Errorf("timed out after %s", timeout)
+		}
+		return tail.String(), err
+	}
+	return "", nil
+}
+
+// turnWriter writes to w holding mutex, which it may share with others.
+type turnWriter struct {
+	mutex *sync.Mutex
+	w     io.Writer
+}
+
+func (t *turnWriter) Write(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.w.Write(p)
+}
+
+// tailWriter keeps the last max bytes written to it.
+type tailWriter struct {
+	mutex sync.Mutex
+	max   int
+	buf   []byte
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailWriter) String() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return string(t.buf)
+}
@@ -0,0 +1,154 @@
+package packager
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// Progress reports how far the download of a dependency, and of all the
+// dependencies of a run, has got. Totals are -1 when they are not known.
+type Progress struct {
+	Dep   string
+	Bytes int64
+	Total int64
+
+	// OverallBytes counts every byte downloaded so far in the run.
+	// OverallTotal is the sum of the sizes of the dependencies which were
+	// not cached when the run started, or -1 when any of them is unknown.
+	OverallBytes int64
+	OverallTotal int64
+}
+
+// progressTracker passes Progress to a callback, one call at a time, so that
+// the callback need not be safe for concurrent use.
+type progressTracker struct {
+	mutex    sync.Mutex
+	callback func(Progress)
+	bytes    int64
+	total    int64
+}
+
+type progressKey struct{}
+
+type dependencyProgress struct {
+	tracker *progressTracker
+	name    string
+}
+
+// forDependency returns a context under which the downloads of name are
+// reported. It returns ctx unchanged on a nil tracker.
+func (t *progressTracker) forDependency(ctx context.Context, name string) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, progressKey{}, dependencyProgress{t, name})
+}
+
+// trackProgress reports reads from r, a download of total bytes, when ctx
+// came from forDependency.
+func trackProgress(ctx context.Context, r io.Reader, total int64) io.Reader {
+	p, ok := ctx.Value(progressKey{}).(dependencyProgress)
+	if !ok {
+		return r
+	}
+	if total < 0 {
+		total = -1
+	}
+	return &progressReader{r: r, dependencyProgress: p, total: total}
+}
+
+type progressReader struct {
+	dependencyProgress
+	r     io.Reader
+	bytes int64
+	total int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		t := p.tracker
+		t.mutex.Lock()
+		p.bytes += int64(n)
+		t.bytes += int64(n)
+		t.callback(Progress{Dep: p.name, Bytes: p.bytes, Total: p.total, OverallBytes: t.bytes, OverallTotal: t.total})
+		t.mutex.Unlock()
+	}
+	return n, err
+}
+
+// expectedBytes adds up the sizes of deps which are to be downloaded, asking
+// the server with a HEAD request, and returns -1 when any of them is
+// unknown. Nothing is downloaded from a dependency pool.
+func (d *downloader) expectedBytes(ctx context.Context, deps []Dependency) int64 {
+	if d.pool != "" {
+		return 0
+	}
+	seen := map[string]bool{}
+	var total int64
+	for _, dep := range deps {
+		if seen[dep.URI] {
+			continue
+		}
+		seen[dep.URI] = true
+
+		uri := d.rewriteURI(dep.URI)
+		if !dep.Revalidate && !(d.skipFileChecksums && isFileURI(uri)) && d.isCached(dep) {
+			continue
+		}
+		size := d.contentLength(ctx, uri)
+		if size < 0 {
+			return -1
+		}
+		total += size
+	}
+	return total
+}
+
+// isCached reports whether dependency has an entry in the cache, which is
+// then reused rather than downloaded unless it turns out to be corrupt.
+func (d *downloader) isCached(dependency Dependency) bool {
+	paths := []string{CachePath(dependency, d.cacheDir), legacyCachePath(dependency, d.cacheDir)}
+	if dependency.SHA256 != "" {
+		paths = append(paths, blobPath(dependency.SHA256, d.cacheDir))
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// contentLength is the size of what uri refers to, or -1 when it cannot be
+// found out.
+func (d *downloader) contentLength(ctx context.Context, uri string) int64 {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return -1
+	}
+	if u.Scheme == "file" {
+		info, err := os.Stat(d.filePath(u))
+		if err != nil {
+			return -1
+		}
+		return info.Size()
+	}
+
+	request, err := d.newRequestWithMethod(ctx, "HEAD", uri)
+	if err != nil {
+		return -1
+	}
+	response, err := d.httpClient().Do(request)
+	if err != nil {
+		return -1
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return -1
+	}
+	return response.ContentLength
+}
@@ -0,0 +1,89 @@
+package packager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChecksumIndexName is the entry of the checksum index written into cached
+// zips when PackageOptions.ChecksumIndex is set.
+const ChecksumIndexName = "dependencies/SHASUMS256.txt"
+
+// ReleaseSummary is the release metadata written next to a zip when
+// PackageOptions.ReleaseSummary is set.
+type ReleaseSummary struct {
+	Language     string              `json:"language"`
+	Version      string              `json:"version"`
+	Stacks       []string            `json:"stacks"`
+	Dependencies []ReleaseDependency `json:"dependencies"`
+	SHA256       string              `json:"sha256"`
+	Built        time.Time           `json:"built"`
+}
+
+type ReleaseDependency struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	URI     string `json:"uri"`
+	SHA256  string `json:"sha256"`
+	// Cached is set when the dependency is included in the zip.
+	Cached bool `json:"cached"`
+}
+
+func releaseSummaryPath(zipFile string) string {
+	return zipFile + ".json"
+}
+
+// writeReleaseSummary describes the zip built from manifest, with the
+// resolved dependencies, in JSON next to the zip and returns its path.
+func writeReleaseSummary(zipFile string, manifest Manifest, version, stack string, result Result, built time.Time) (string, error) {
+	summary := ReleaseSummary{
+		Language:     manifest.Language,
+		Version:      version,
+		Stacks:       append([]string{}, result.Stacks...),
+		Dependencies: []ReleaseDependency{},
+		SHA256:       result.SHA256,
+		Built:        built.UTC(),
+	}
+	for _, dep := range result.Dependencies {
+		summary.Dependencies = append(summary.Dependencies, ReleaseDependency{
+			Name:    dep.Name,
+			Version: dep.Version,
+			URI:     dep.URI,
+			SHA256:  dep.SHA256,
+			Cached:  dep.Included,
+		})
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := releaseSummaryPath(zipFile)
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// checksumIndex lists the sha256 of each dependency file, in the format of
+// sha256sum, relative to the directory of ChecksumIndexName so that
+// running sha256sum -c there verifies them. Lines are sorted by path.
+func checksumIndex(files []File) (ExtraFile, error) {
+	files = append([]File{}, files...)
+	sort.Slice(files, func(i, j int) bool { return zipEntryName(files[i].Name) < zipEntryName(files[j].Name) })
+
+	var index strings.Builder
+	for _, file := range files {
+		sum, err := sha256File(file.Path)
+		if err != nil {
+			return ExtraFile{}, err
+		}
+		fmt.Fprintf(&index, "%s  %s\n", sum, strings.TrimPrefix(zipEntryName(file.Name), path.Dir(ChecksumIndexName)+"/"))
+	}
+	return ExtraFile{Name: ChecksumIndexName, Contents: []byte(index.String())}, nil
+}
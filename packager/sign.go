@@ -0,0 +1,50 @@
+package packager
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// SignFile writes an ASCII-armored GPG detached signature of path to
+// path + ".asc" using the private key stored in keyFile. The key is imported
+// into a throwaway keyring so the caller's own keyring is never touched.
+func SignFile(path, keyFile string) (string, error) {
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read signing key %s: %v", keyFile, err)
+	}
+	if len(bytes.TrimSpace(key)) == 0 {
+		return "", fmt.Errorf("Signing key %s is empty", keyFile)
+	}
+
+	home, err := ioutil.TempDir("", "buildpack-packager-gpg")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(home)
+
+	if err := runGPG(home, bytes.NewReader(key), "--import"); err != nil {
+		return "", fmt.Errorf("Failed to import signing key %s: %v", keyFile, err)
+	}
+
+	signature := path + ".asc"
+	if err := runGPG(home, nil, "--yes", "--armor", "--detach-sign", "--output", signature, path); err != nil {
+		return "", fmt.Errorf("Failed to sign %s: %v", path, err)
+	}
+
+	return signature, nil
+}
+
+func runGPG(home string, stdin *bytes.Reader, args ...string) error {
+	cmd := exec.Command("gpg", append([]string{"--batch", "--no-tty", "--pinentry-mode", "loopback", "--passphrase", "", "--homedir", home}, args...)...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package packager_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack/packager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SignFile", func() {
+	var (
+		tmpDir  string
+		gpgHome string
+		keyFile string
+		zipFile string
+	)
+
+	gpg := func(args ...string) []byte {
+		out, err := exec.Command("gpg", append([]string{"--batch", "--homedir", gpgHome}, args...)...).CombinedOutput()
+		Expect(err).NotTo(HaveOccurred(), string(out))
+		return out
+	}
+
+	BeforeEach(func() {
+		if _, err := exec.LookPath("gpg"); err != nil {
+			Skip("gpg is not installed")
+		}
+
+		var err error
+		tmpDir, err = ioutil.TempDir("", "packager-sign")
+		Expect(err).NotTo(HaveOccurred())
+
+		gpgHome = filepath.Join(tmpDir, "gnupg")
+		Expect(os.Mkdir(gpgHome, 0700)).To(Succeed())
+		gpg("--passphrase", "", "--quick-gen-key", "Test Packager <test@example.com>", "default", "default", "never")
+
+		keyFile = filepath.Join(tmpDir, "key.asc")
+		Expect(ioutil.WriteFile(keyFile, gpg("--armor", "--export-secret-keys"), 0600)).To(Succeed())
+
+		zipFile = filepath.Join(tmpDir, "buildpack.zip")
+		Expect(ioutil.WriteFile(zipFile, []byte("zip contents"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() { os.RemoveAll(tmpDir) })
+
+	It("writes a detached signature next to the file", func() {
+		signature, err := packager.SignFile(zipFile, keyFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(signature).To(Equal(zipFile + ".asc"))
+
+		gpg("--verify", signature, zipFile)
+	})
+
+	It("returns an error when the key is missing", func() {
+		_, err := packager.SignFile(zipFile, filepath.Join(tmpDir, "missing.asc"))
+		Expect(err).To(MatchError(ContainSubstring("Failed to read signing key")))
+	})
+
+	It("returns an error when the key is not a key", func() {
+		Expect(ioutil.WriteFile(keyFile, []byte("not a key"), 0600)).To(Succeed())
+		_, err := packager.SignFile(zipFile, keyFile)
+		Expect(err).To(MatchError(ContainSubstring("Failed to import signing key")))
+	})
+})
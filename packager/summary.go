@@ -54,11 +54,28 @@ func Summary(bpDir string) (string, error) {
 		}
 	}
 
+	hasStackDefaults := false
+	for _, d := range manifest.Defaults {
+		if len(d.Stacks) > 0 {
+			hasStackDefaults = true
+			break
+		}
+	}
+
 	if len(manifest.Defaults) > 0 {
 		out += "\nDefault binary versions:\n\n"
-		out += "| name | version |\n|-|-|\n"
+		if hasStackDefaults {
+			out += "| name | version | cf_stacks |\n|-|-|-|\n"
+		} else {
+			out += "| name | version |\n|-|-|\n"
+		}
 		for _, d := range manifest.Defaults {
-			out += fmt.Sprintf("| %s | %s |\n", d.Name, d.Version)
+			if hasStackDefaults {
+				sort.Strings(d.Stacks)
+				out += fmt.Sprintf("| %s | %s | %s |\n", d.Name, d.Version, strings.Join(d.Stacks, ", "))
+			} else {
+				out += fmt.Sprintf("| %s | %s |\n", d.Name, d.Version)
+			}
 		}
 	}
 
@@ -53,6 +53,25 @@ Packaged binaries:
 			})
 		})
 
+		Context("default versions differ by stack", func() {
+			BeforeEach(func() {
+				buildpackDir = "./fixtures/stack_defaults"
+			})
+			It("Renders the stacks of the default versions", func() {
+				s, e := packager.Summary(buildpackDir)
+				Expect(e).NotTo(HaveOccurred())
+				Expect(s).To(HaveSuffix(`
+Default binary versions:
+
+| name | version | cf_stacks |
+|-|-|-|
+| ruby | 2.6.x | cflinuxfs2 |
+| ruby | 2.7.x | cflinuxfs3 |
+| bundler | 1.x |  |
+`))
+			})
+		})
+
 		Context("no dependencies", func() {
 			BeforeEach(func() {
 				buildpackDir = "./fixtures/no_dependencies"
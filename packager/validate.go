@@ -0,0 +1,377 @@
+package packager
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ManifestError lists every problem found while validating a manifest.
+type ManifestError struct {
+	Problems []string
+}
+
+func (e ManifestError) Error() string {
+	return fmt.Sprintf("Invalid manifest.yml:\n  - %s", strings.Join(e.Problems, "\n  - "))
+}
+
+// ValidateManifest checks the manifest.yml in bpDir for the structure that
+// Package relies on, reporting all problems at once.
+//
+// The language key is required. The dependencies key may be left out or
+// empty, for buildpacks with nothing to download. When any dependencies
+// are declared, default_versions is required as well, and every dependency
+// must have a uri, at least one of a sha1, sha256 or sha512 checksum and at
+// least one entry in cf_stacks unless the manifest has a top-level stack.
+// The same name and version may only be declared once per stack.
+//
+// A top-level stacks list, when present, declares the stacks the manifest
+// supports, and every cf_stacks entry must be one of them. Stacks in the
+// cf_stacks of default_versions must be declared or, without a stacks
+// list, have dependencies built for them.
+func ValidateManifest(bpDir string) error {
+	return validateManifest(bpDir, false)
+}
+
+// validateManifest is ValidateManifest, accepting dependencies without a
+// checksum when allowUnchecked is set.
+func validateManifest(bpDir string, allowUnchecked bool) error {
+	data, err := ioutil.ReadFile(filepath.Join(bpDir, "manifest.yml"))
+	if err != nil {
+		return err
+	}
+
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return ManifestError{Problems: []string{fmt.Sprintf("could not parse manifest.yml: %v", err)}}
+	}
+
+	var problems []string
+	if language, ok := m["language"].(string); !ok || language == "" {
+		problems = append(problems, "missing required key: language")
+	}
+
+	rawDeps := m["dependencies"]
+	deps, ok := rawDeps.([]interface{})
+	if rawDeps != nil && !ok {
+		problems = append(problems, "dependencies must be a list")
+	}
+
+	if _, ok := m["default_versions"]; !ok && len(deps) > 0 {
+		problems = append(problems, "missing required key: default_versions")
+	}
+
+	declared := map[string]bool{}
+	rawStacks, hasDeclared := m["stacks"]
+	if hasDeclared {
+		list, ok := rawStacks.([]interface{})
+		if !ok {
+			problems = append(problems, "stacks must be a list")
+		}
+		for _, stack := range list {
+			declared[fmt.Sprint(stack)] = true
+		}
+	}
+
+	// Packaged manifests move the stack to the top level.
+	_, packaged := m["stack"]
+	seen := map[string]int{}
+	built := map[string]bool{}
+	for idx, raw := range deps {
+		dep, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("dependency #%d must be a map", idx+1))
+			continue
+		}
+
+		label := dependencyLabel(idx, dep)
+		if value, _ := dep["uri"].(string); value == "" {
+			problems = append(problems, fmt.Sprintf("%s is missing uri", label))
+		}
+		problems = append(problems, checksumProblems(label, dep, allowUnchecked)...)
+		if timeout, ok := dep["download_timeout"]; ok {
+			if _, err := time.ParseDuration(fmt.Sprint(timeout)); err != nil {
+				problems = append(problems, fmt.Sprintf("%s has an invalid download_timeout: %v", label, timeout))
+			}
+		}
+
+		stacks, _ := dep["cf_stacks"].([]interface{})
+		if len(stacks) == 0 && !packaged {
+			problems = append(problems, fmt.Sprintf("%s has no cf_stacks", label))
+		}
+		for _, stack := range stacks {
+			built[fmt.Sprint(stack)] = true
+			if hasDeclared && !declared[fmt.Sprint(stack)] {
+				problems = append(problems, fmt.Sprintf("%s lists unknown stack %v", label, stack))
+			}
+		}
+		if packaged {
+			stacks = []interface{}{m["stack"]}
+		}
+
+		for _, stack := range stacks {
+			key := fmt.Sprintf("%v\x00%v\x00%v", dep["name"], dep["version"], stack)
+			if first, ok := seen[key]; ok {
+				problems = append(problems, fmt.Sprintf("%s duplicates dependency #%d for stack %v", label, first+1, stack))
+			} else {
+				seen[key] = idx
+			}
+		}
+	}
+
+	known := declared
+	if !hasDeclared {
+		known = built
+	}
+	defaults, _ := m["default_versions"].([]interface{})
+	for _, raw := range defaults {
+		d, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		stacks, _ := d["cf_stacks"].([]interface{})
+		for _, stack := range stacks {
+			if !known[fmt.Sprint(stack)] {
+				problems = append(problems, fmt.Sprintf("default version of %v lists unknown stack %v", d["name"], stack))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return ManifestError{Problems: problems}
+	}
+	return nil
+}
+
+// strayStackWarnings describes each stack of a dependency in manifest which
+// no other dependency or default version lists, while some other stack is
+// listed more than once, such as a mistyped cflinuxfs3. Manifests with a
+// top-level stacks list have their stacks checked by ValidateManifest
+// instead.
+func strayStackWarnings(manifest Manifest) []string {
+	if len(manifest.DeclaredStacks) > 0 {
+		return nil
+	}
+
+	listed := map[string]int{}
+	for _, dep := range manifest.Dependencies {
+		for _, s := range dep.Stacks {
+			listed[s]++
+		}
+	}
+	for _, d := range manifest.Defaults {
+		for _, s := range d.Stacks {
+			listed[s]++
+		}
+	}
+	most := 0
+	for _, n := range listed {
+		if n > most {
+			most = n
+		}
+	}
+	if most < 2 {
+		return nil
+	}
+
+	var warnings []string
+	for _, dep := range manifest.Dependencies {
+		for _, s := range dep.Stacks {
+			if listed[s] == 1 {
+				warnings = append(warnings, fmt.Sprintf("Dependency %s %s lists stack %s, which nothing else in the manifest does", dep.Name, dep.Version, s))
+			}
+		}
+	}
+	return warnings
+}
+
+// ValidateDefaultVersions checks that every default_versions entry of the
+// manifest in bpDir matches a dependency on each stack that the manifest's
+// dependencies are built for, reporting every stack and default that does
+// not. Entries with cf_stacks are only checked on their stacks; see
+// DefaultVersion.
+func ValidateDefaultVersions(bpDir string) error {
+	manifest, err := readManifest(bpDir)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for _, stack := range manifest.stacks() {
+		problems = append(problems, defaultVersionProblems(manifest, stack)...)
+	}
+	if len(problems) > 0 {
+		return ManifestError{Problems: problems}
+	}
+	return nil
+}
+
+// UnreferencedDependencies lists the dependencies of the manifest in bpDir
+// which no default_versions entry selects on stack, or on any of their
+// stacks when stack is empty. They are candidates for pruning, since they
+// still make cached buildpacks larger.
+func UnreferencedDependencies(bpDir, stack string) ([]Dependency, error) {
+	manifest, err := readManifest(bpDir)
+	if err != nil {
+		return nil, err
+	}
+
+	stacks := []string{stack}
+	if stack == "" {
+		stacks = manifest.stacks()
+	}
+
+	referenced := map[string]bool{}
+	for _, s := range stacks {
+		for _, i := range manifest.stackDefaults(s) {
+			d := manifest.Defaults[i]
+			if version, err := libbuildpack.FindMatchingVersion(d.Version, manifest.versionsOfDependencyWithStack(d.Name, s)); err == nil {
+				referenced[d.Name+"\x00"+version+"\x00"+s] = true
+			}
+		}
+	}
+
+	var unreferenced []Dependency
+	for _, dep := range manifest.Dependencies {
+		used, packaged := false, false
+		for _, s := range stacks {
+			if containsString(dep.Stacks, s) {
+				packaged = true
+				used = used || referenced[dep.Name+"\x00"+dep.Version+"\x00"+s]
+			}
+		}
+		if packaged && !used {
+			unreferenced = append(unreferenced, dep)
+		}
+	}
+	return unreferenced, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultVersionProblems describes each default version applying on stack with
+// no matching dependency for stack, and each name with more than one.
+func defaultVersionProblems(manifest Manifest, stack string) []string {
+	var missing []string
+	seen := map[string]bool{}
+	for _, i := range manifest.stackDefaults(stack) {
+		d := manifest.Defaults[i]
+		if seen[d.Name] {
+			missing = append(missing, fmt.Sprintf("Multiple default versions of `%s` for stack `%s`", d.Name, stack))
+			continue
+		}
+		seen[d.Name] = true
+		if _, err := libbuildpack.FindMatchingVersion(d.Version, manifest.versionsOfDependencyWithStack(d.Name, stack)); err != nil {
+			missing = append(missing, fmt.Sprintf("No matching default dependency `%s` for stack `%s`", d.Name, stack))
+		}
+	}
+	return missing
+}
+
+// checksumAlgorithms are the checksum fields a dependency may declare.
+var checksumAlgorithms = []string{"sha1", "sha256", "sha512"}
+
+// checksumProblems reports a dependency that declares no supported checksum,
+// unless allowUnchecked is set, an empty one alongside another checksum, or
+// a field for an algorithm the packager cannot verify.
+func checksumProblems(label string, dep map[interface{}]interface{}, allowUnchecked bool) []string {
+	var problems, empty []string
+	found := false
+	for _, algorithm := range checksumAlgorithms {
+		raw, ok := dep[algorithm]
+		if !ok {
+			continue
+		}
+		if value, _ := raw.(string); value == "" {
+			empty = append(empty, fmt.Sprintf("%s has an empty %s", label, algorithm))
+		} else {
+			found = true
+		}
+	}
+	if found {
+		problems = append(problems, empty...)
+	} else if !allowUnchecked {
+		problems = append(problems, fmt.Sprintf("%s is missing a checksum", label))
+	}
+
+	var unknown []string
+	for key := range dep {
+		name := fmt.Sprint(key)
+		if (strings.HasPrefix(name, "sha") || name == "md5") && !containsString(checksumAlgorithms, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, fmt.Sprintf("%s has an unsupported checksum %s, use one of %s", label, name, strings.Join(checksumAlgorithms, ", ")))
+	}
+	return problems
+}
+
+func dependencyLabel(idx int, dep map[interface{}]interface{}) string {
+	return fmt.Sprintf("dependency #%d (%v %v)", idx+1, dep["name"], dep["version"])
+}
+
+// checkSkippedIncludes reports include_files entries in bpDir which lie in
+// a directory that copying skips, and so would silently be missing from the
+// zip. Patterns are not checked, since they may match skipped files
+// without meaning to.
+func checkSkippedIncludes(bpDir string, includeFiles, skipDirs []string) error {
+	if skipDirs == nil {
+		skipDirs = DefaultSkipDirs
+	}
+	var conflicts []string
+	for _, entry := range includeFiles {
+		if strings.ContainsAny(entry, "*?[") {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(bpDir, entry))
+		if err != nil {
+			continue
+		}
+		rel := path.Clean(filepath.ToSlash(entry))
+		var skipped string
+		for dir := rel; dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if (dir != rel || info.IsDir()) && isSkippedDir(dir, skipDirs) {
+				skipped = dir
+			}
+		}
+		if skipped != "" {
+			conflicts = append(conflicts, fmt.Sprintf("IncludeFiles references %s but %s is skipped", entry, skipped))
+		}
+	}
+	if len(conflicts) > 0 {
+		return errors.New(strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// checkIncludeFiles reports every include_files entry missing from dir.
+func checkIncludeFiles(dir string, includeFiles []string) error {
+	var missing []string
+	for _, name := range includeFiles {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("include_files not found in buildpack: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package packager_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack/packager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ValidateManifest", func() {
+	var bpDir string
+
+	BeforeEach(func() {
+		var err error
+		bpDir, err = ioutil.TempDir("", "packager-validate")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() { os.RemoveAll(bpDir) })
+
+	writeManifest := func(contents string) {
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), []byte(contents), 0644)).To(Succeed())
+	}
+
+	It("accepts a valid manifest", func() {
+		Expect(packager.ValidateManifest("./fixtures/good")).To(Succeed())
+	})
+
+	It("accepts a manifest without dependencies", func() {
+		Expect(packager.ValidateManifest("./fixtures/no_dependencies")).To(Succeed())
+		Expect(packager.ValidateManifest("./fixtures/without_dependencies")).To(Succeed())
+	})
+
+	It("reports missing top-level keys", func() {
+		writeManifest("---\ninclude_files: []\n")
+
+		err := packager.ValidateManifest(bpDir)
+		Expect(err).To(BeAssignableToTypeOf(packager.ManifestError{}))
+		Expect(err.(packager.ManifestError).Problems).To(Equal([]string{
+			"missing required key: language",
+		}))
+	})
+
+	It("reports every invalid dependency", func() {
+		writeManifest(`---
+language: ruby
+dependencies:
+- name: ruby
+  version: 1.2.3
+  sha256: abc
+  uri: https://example.com/ruby.tgz
+  cf_stacks: [cflinuxfs3]
+- name: node
+  version: 4.5.6
+  cf_stacks: []
+- not a map
+`)
+
+		err := packager.ValidateManifest(bpDir)
+		Expect(err).To(BeAssignableToTypeOf(packager.ManifestError{}))
+		Expect(err.(packager.ManifestError).Problems).To(Equal([]string{
+			"missing required key: default_versions",
+			"dependency #2 (node 4.5.6) is missing uri",
+			"dependency #2 (node 4.5.6) is missing a checksum",
+			"dependency #2 (node 4.5.6) has no cf_stacks",
+			"dependency #3 must be a map",
+		}))
+		Expect(err.Error()).To(HavePrefix("Invalid manifest.yml:\n  - missing required key: default_versions\n  - dependency #2"))
+	})
+
+	It("reports stacks the manifest does not declare", func() {
+		writeManifest(`---
+language: ruby
+stacks: [cflinuxfs3, cflinuxfs4]
+default_versions:
+- name: ruby
+  version: 1.x
+  cf_stacks: [cflinux4]
+dependencies:
+- name: ruby
+  version: 1.2.3
+  sha256: abc
+  uri: https://example.com/ruby-fs3.tgz
+  cf_stacks: [cflinuxfs3, cflinuxf4]
+`)
+		err := packager.ValidateManifest(bpDir)
+		Expect(err).To(BeAssignableToTypeOf(packager.ManifestError{}))
+		Expect(err.(packager.ManifestError).Problems).To(Equal([]string{
+			"dependency #1 (ruby 1.2.3) lists unknown stack cflinuxf4",
+			"default version of ruby lists unknown stack cflinux4",
+		}))
+	})
+
+	It("reports default versions for stacks no dependency is built for", func() {
+		writeManifest(`---
+language: ruby
+default_versions:
+- name: ruby
+  version: 1.x
+  cf_stacks: [cflinuxfs4]
+dependencies:
+- name: ruby
+  version: 1.2.3
+  sha256: abc
+  uri: https://example.com/ruby-fs3.tgz
+  cf_stacks: [cflinuxfs3]
+`)
+		Expect(packager.ValidateManifest(bpDir)).To(MatchError(ContainSubstring("default version of ruby lists unknown stack cflinuxfs4")))
+	})
+
+	It("reports duplicate dependencies for the same stack", func() {
+		writeManifest(`---
+language: ruby
+default_versions: []
+dependencies:
+- name: ruby
+  version: 1.2.3
+  sha256: abc
+  uri: https://example.com/ruby-fs2.tgz
+  cf_stacks: [cflinuxfs2, cflinuxfs3]
+- name: ruby
+  version: 1.2.3
+  sha256: def
+  uri: https://example.com/ruby-fs4.tgz
+  cf_stacks: [cflinuxfs4]
+- name: ruby
+  version: 1.2.3
+  sha256: abc
+  uri: https://example.com/ruby-fs2.tgz
+  cf_stacks: [cflinuxfs3]
+- name: ruby
+  version: 2.0.0
+  sha256: abc
+  uri: https://example.com/ruby-2.tgz
+  cf_stacks: [cflinuxfs3]
+`)
+
+		err := packager.ValidateManifest(bpDir)
+		Expect(err).To(BeAssignableToTypeOf(packager.ManifestError{}))
+		Expect(err.(packager.ManifestError).Problems).To(Equal([]string{
+			"dependency #3 (ruby 1.2.3) duplicates dependency #1 for stack cflinuxfs3",
+		}))
+	})
+
+	It("reports invalid download timeouts", func() {
+		writeManifest(`---
+language: ruby
+default_versions: []
+dependencies:
+- name: ruby
+  version: 1.2.3
+  sha256: abc
+  uri: https://example.com/ruby.tgz
+  cf_stacks: [cflinuxfs3]
+  download_timeout: soon
+`)
+
+		Expect(packager.ValidateManifest(bpDir)).To(MatchError(ContainSubstring("dependency #1 (ruby 1.2.3) has an invalid download_timeout: soon")))
+	})
+
+	It("accepts any supported checksum and reports unusable ones", func() {
+		writeManifest(`---
+language: ruby
+default_versions: []
+dependencies:
+- name: ruby
+  version: 1.2.3
+  sha512: abc
+  uri: https://example.com/ruby.tgz
+  cf_stacks: [cflinuxfs3]
+- name: node
+  version: 4.5.6
+  sha1: abc
+  sha256: ""
+  md5: abc
+  sha384: abc
+  uri: https://example.com/node.tgz
+  cf_stacks: [cflinuxfs3]
+`)
+
+		err := packager.ValidateManifest(bpDir)
+		Expect(err).To(BeAssignableToTypeOf(packager.ManifestError{}))
+		Expect(err.(packager.ManifestError).Problems).To(Equal([]string{
+			"dependency #2 (node 4.5.6) has an empty sha256",
+			"dependency #2 (node 4.5.6) has an unsupported checksum md5, use one of sha1, sha256, sha512",
+			"dependency #2 (node 4.5.6) has an unsupported checksum sha384, use one of sha1, sha256, sha512",
+		}))
+	})
+
+	It("reports dependencies that are not a list", func() {
+		writeManifest("---\nlanguage: ruby\ndependencies: nope\n")
+
+		Expect(packager.ValidateManifest(bpDir)).To(MatchError(ContainSubstring("dependencies must be a list")))
+	})
+
+	It("is run by Package before anything is downloaded", func() {
+		writeManifest("---\nlanguage: ruby\ndependencies: nope\n")
+
+		_, err := packager.Package(bpDir, bpDir, "1.2.3", "", true)
+		Expect(err).To(MatchError(ContainSubstring("dependencies must be a list")))
+	})
+})
+
+var _ = Describe("ValidateDefaultVersions", func() {
+	var bpDir string
+
+	BeforeEach(func() {
+		var err error
+		bpDir, err = ioutil.TempDir("", "packager-validate-defaults")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() { os.RemoveAll(bpDir) })
+
+	It("accepts defaults that resolve on every stack", func() {
+		Expect(packager.ValidateDefaultVersions("./fixtures/good")).To(Succeed())
+	})
+
+	It("resolves defaults scoped to a stack on that stack only", func() {
+		Expect(packager.ValidateDefaultVersions("./fixtures/stack_defaults")).To(Succeed())
+	})
+
+	It("reports more than one default of a name for a stack", func() {
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), []byte(`---
+language: ruby
+default_versions:
+- name: ruby
+  version: 2.x
+  cf_stacks: [cflinuxfs3]
+- name: ruby
+  version: 2.6.x
+  cf_stacks: [cflinuxfs3]
+dependencies:
+- name: ruby
+  version: 2.6.0
+  cf_stacks: [cflinuxfs3]
+`), 0644)).To(Succeed())
+
+		err := packager.ValidateDefaultVersions(bpDir)
+		Expect(err).To(BeAssignableToTypeOf(packager.ManifestError{}))
+		Expect(err.(packager.ManifestError).Problems).To(Equal([]string{
+			"Multiple default versions of `ruby` for stack `cflinuxfs3`",
+		}))
+	})
+
+	It("reports every stack a default does not resolve on", func() {
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), []byte(`---
+language: ruby
+default_versions:
+- name: ruby
+  version: 2.x
+- name: node
+  version: 10.x
+dependencies:
+- name: ruby
+  version: 2.6.0
+  cf_stacks: [cflinuxfs3]
+- name: ruby
+  version: 1.9.3
+  cf_stacks: [cflinuxfs2]
+- name: node
+  version: 10.1.0
+  cf_stacks: [cflinuxfs3, cflinuxfs2]
+- name: node
+  version: 12.1.0
+  cf_stacks: [windows]
+`), 0644)).To(Succeed())
+
+		err := packager.ValidateDefaultVersions(bpDir)
+		Expect(err).To(BeAssignableToTypeOf(packager.ManifestError{}))
+		Expect(err.(packager.ManifestError).Problems).To(Equal([]string{
+			"No matching default dependency `ruby` for stack `cflinuxfs2`",
+			"No matching default dependency `ruby` for stack `windows`",
+			"No matching default dependency `node` for stack `windows`",
+		}))
+	})
+})
+
+var _ = Describe("UnreferencedDependencies", func() {
+	var bpDir string
+
+	BeforeEach(func() {
+		var err error
+		bpDir, err = ioutil.TempDir("", "packager-validate-unreferenced")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(bpDir, "manifest.yml"), []byte(`---
+language: ruby
+default_versions:
+- name: ruby
+  version: 2.x
+dependencies:
+- name: ruby
+  version: 2.5.0
+  uri: https://example.com/ruby-2.5.0.tgz
+  cf_stacks: [cflinuxfs3]
+- name: ruby
+  version: 2.6.0
+  uri: https://example.com/ruby-2.6.0.tgz
+  cf_stacks: [cflinuxfs3]
+- name: ruby
+  version: 2.5.0
+  uri: https://example.com/ruby-2.5.0-fs2.tgz
+  cf_stacks: [cflinuxfs2]
+- name: bundler
+  version: 1.17.0
+  uri: https://example.com/bundler.tgz
+  cf_stacks: [cflinuxfs3]
+`), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() { os.RemoveAll(bpDir) })
+
+	uris := func(deps []packager.Dependency) []string {
+		var uris []string
+		for _, dep := range deps {
+			uris = append(uris, dep.URI)
+		}
+		return uris
+	}
+
+	It("lists the dependencies no default selects on the stack", func() {
+		deps, err := packager.UnreferencedDependencies(bpDir, "cflinuxfs3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(uris(deps)).To(Equal([]string{"https://example.com/ruby-2.5.0.tgz", "https://example.com/bundler.tgz"}))
+	})
+
+	It("selects with the defaults for each stack", func() {
+		deps, err := packager.UnreferencedDependencies("./fixtures/stack_defaults", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deps).To(BeEmpty())
+	})
+
+	It("considers every stack when none is given", func() {
+		deps, err := packager.UnreferencedDependencies(bpDir, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(uris(deps)).To(Equal([]string{"https://example.com/ruby-2.5.0.tgz", "https://example.com/bundler.tgz"}))
+	})
+})
@@ -0,0 +1,166 @@
+package packager
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ZipMismatchError lists every way a zip differs from a manifest.
+type ZipMismatchError struct {
+	Zip, Manifest string
+	Problems      []string
+}
+
+func (e ZipMismatchError) Error() string {
+	return fmt.Sprintf("%s does not match %s:\n  - %s", e.Zip, e.Manifest, strings.Join(e.Problems, "\n  - "))
+}
+
+// VerifyZip checks that the cached buildpack zip at zipPath holds exactly
+// the dependencies declared by the manifest at manifestPath, each matching
+// its checksums. The manifest may be the one packaged in the zip, or the
+// buildpack's own manifest, in which case only the dependencies for the
+// stack the zip was packaged for are expected. A checksum index written by
+// PackageOptions.ChecksumIndex is accepted. Files added through
+// PackageOptions.ExtraDependencies are not in the manifest, so they are
+// reported as unexpected. Discrepancies are reported together as a
+// ZipMismatchError.
+func VerifyZip(zipPath, manifestPath string) error {
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	var manifest Manifest
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", manifestPath, err)
+	}
+
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	entries := map[string]*zip.File{}
+	for _, f := range reader.File {
+		entries[f.Name] = f
+	}
+
+	stack := manifest.Stack
+	if stack == "" {
+		if stack, err = packagedStack(entries["manifest.yml"]); err != nil {
+			return fmt.Errorf("Failed to read manifest.yml from %s: %v", zipPath, err)
+		}
+	}
+
+	var problems []string
+	expected := map[string]bool{ChecksumIndexName: true}
+	for _, dep := range manifest.Dependencies {
+		if manifest.Stack == "" && stack != "" && !forStack(dep, stack) {
+			continue
+		}
+		name := dep.File
+		if name == "" {
+			name = dependencyFileName(dep)
+		}
+		name = zipEntryName(name)
+		expected[name] = true
+
+		f, ok := entries[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s %s: %s is missing", dep.Name, dep.Version, name))
+			continue
+		}
+		if err := checkZipEntryChecksums(f, dep); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s: %s: %v", dep.Name, dep.Version, name, err))
+		}
+	}
+
+	var unexpected []string
+	for name, f := range entries {
+		if strings.HasPrefix(name, "dependencies/") && !f.Mode().IsDir() && !expected[name] {
+			unexpected = append(unexpected, name)
+		}
+	}
+	sort.Strings(unexpected)
+	for _, name := range unexpected {
+		problems = append(problems, fmt.Sprintf("unexpected dependency file %s", name))
+	}
+
+	if len(problems) > 0 {
+		return ZipMismatchError{Zip: zipPath, Manifest: manifestPath, Problems: problems}
+	}
+	return nil
+}
+
+// packagedStack returns the stack recorded in a packaged manifest.yml, or
+// "" when there is none or the buildpack was packaged for any stack.
+func packagedStack(f *zip.File) (string, error) {
+	if f == nil {
+		return "", nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return "", err
+	}
+	var manifest Manifest
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return "", err
+	}
+	return manifest.Stack, nil
+}
+
+// checkZipEntryChecksums verifies the contents of f against every checksum
+// dep declares, reading it once.
+func checkZipEntryChecksums(f *zip.File, dep Dependency) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	sums := []struct {
+		algorithm, expected string
+		hash                hash.Hash
+	}{
+		{"sha256", dep.SHA256, sha256.New()},
+		{"sha512", dep.SHA512, sha512.New()},
+		{"sha1", dep.SHA1, sha1.New()},
+	}
+	writers := []io.Writer{}
+	for _, sum := range sums {
+		writers = append(writers, sum.hash)
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), rc); err != nil {
+		return err
+	}
+
+	for _, sum := range sums {
+		if sum.expected == "" {
+			continue
+		}
+		if actual := hex.EncodeToString(sum.hash.Sum(nil)); actual != sum.expected {
+			return ChecksumMismatchError{Dep: dep, Algorithm: sum.algorithm, Expected: sum.expected, Actual: actual}
+		}
+	}
+	if !dep.hasChecksum() {
+		return fmt.Errorf("dependency has no checksum")
+	}
+	return nil
+}
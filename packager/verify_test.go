@@ -0,0 +1,88 @@
+package packager_test
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack/packager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("VerifyZip", func() {
+	var (
+		tmpDir, zipFile, manifestFile string
+		extras                        []packager.ExtraFile
+	)
+
+	const manifest = `---
+language: ruby
+default_versions: []
+dependencies:
+- name: dep-1
+  version: 1.0.0
+  uri: https://example.com/dep-1
+  sha256: %x
+  cf_stacks: [cflinuxfs3]
+- name: dep-2
+  version: 2.0.0
+  uri: https://example.com/dep-2
+  sha256: %x
+  cf_stacks: [cflinuxfs3]
+- name: dep-3
+  version: 3.0.0
+  uri: https://example.com/dep-3
+  sha256: abc
+  cf_stacks: [cflinuxfs4]
+`
+
+	entryName := func(uri string) string {
+		return fmt.Sprintf("dependencies/%x/%s", md5.Sum([]byte(uri)), filepath.Base(uri))
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "packager-verify")
+		Expect(err).NotTo(HaveOccurred())
+		zipFile = filepath.Join(tmpDir, "buildpack.zip")
+		manifestFile = filepath.Join(tmpDir, "manifest.yml")
+		Expect(ioutil.WriteFile(manifestFile, []byte(fmt.Sprintf(manifest, sha256.Sum256([]byte("one")), sha256.Sum256([]byte("two")))), 0644)).To(Succeed())
+
+		extras = []packager.ExtraFile{
+			{Name: "manifest.yml", Contents: []byte("---\nstack: cflinuxfs3\n")},
+			{Name: entryName("https://example.com/dep-1"), Contents: []byte("one")},
+			{Name: entryName("https://example.com/dep-2"), Contents: []byte("two")},
+		}
+	})
+
+	AfterEach(func() { os.RemoveAll(tmpDir) })
+
+	writeZip := func() {
+		Expect(packager.ZipFilesWithOptions(zipFile, nil, packager.ZipOptions{ExtraFiles: extras})).To(Succeed())
+	}
+
+	It("accepts a zip holding the dependencies for its stack", func() {
+		writeZip()
+		Expect(packager.VerifyZip(zipFile, manifestFile)).To(Succeed())
+	})
+
+	It("reports missing, modified and unexpected dependency files", func() {
+		extras[1].Contents = []byte("tampered")
+		extras = append(extras[:2], packager.ExtraFile{Name: "dependencies/0123/stale.tgz", Contents: []byte("old")})
+		writeZip()
+
+		err := packager.VerifyZip(zipFile, manifestFile)
+		Expect(err).To(BeAssignableToTypeOf(packager.ZipMismatchError{}))
+		Expect(err.(packager.ZipMismatchError).Problems).To(Equal([]string{
+			fmt.Sprintf("dep-1 1.0.0: %s: dependency sha256 mismatch: expected sha256 %x, actual sha256 %x", entryName("https://example.com/dep-1"), sha256.Sum256([]byte("one")), sha256.Sum256([]byte("tampered"))),
+			fmt.Sprintf("dep-2 2.0.0: %s is missing", entryName("https://example.com/dep-2")),
+			"unexpected dependency file dependencies/0123/stale.tgz",
+		}))
+		Expect(err.Error()).To(HavePrefix(zipFile + " does not match " + manifestFile + ":\n  - dep-1 1.0.0"))
+	})
+})
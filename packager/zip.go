@@ -0,0 +1,600 @@
+package packager
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ZipOptions struct {
+	// Context, when set, stops the archive being written once it is done.
+	// The unfinished archive is removed.
+	Context context.Context
+
+	// OnFile, when set, is called after each file is added to the archive.
+	OnFile func(File)
+
+	// SkipVerify disables reopening the finished archive to check that
+	// every entry is present and readable.
+	SkipVerify bool
+
+	// ExtraFiles are written to the archive from memory, in name order
+	// along with the files.
+	ExtraFiles []ExtraFile
+
+	// Comment is stored as the archive comment, shown by tools such as
+	// unzip -l. It does not change the entries.
+	Comment string
+
+	// NormalizeModes stores directories and executables as 0755 and other
+	// files as 0644, whatever their modes on disk, so that the archive
+	// does not depend on the umask it was built with. Symlinks are left
+	// alone.
+	NormalizeModes bool
+
+	// Compressor, when set, replaces the standard library's deflate
+	// compressor, for instance with a parallel implementation. It must
+	// still write a valid deflate stream so that the archive extracts as
+	// usual. Stored entries are not affected.
+	Compressor zip.Compressor
+}
+
+// entryMode is the mode mode is stored as.
+func (options ZipOptions) entryMode(mode os.FileMode) os.FileMode {
+	if !options.NormalizeModes {
+		return mode
+	}
+	switch {
+	case mode.IsDir():
+		return os.ModeDir | 0755
+	case mode&os.ModeSymlink != 0:
+		return mode
+	case mode&0111 != 0:
+		return 0755
+	default:
+		return 0644
+	}
+}
+
+// ExtraFile is a file added to an archive from memory rather than from
+// disk, such as generated build metadata.
+type ExtraFile struct {
+	Name     string
+	Contents []byte
+	// Mode defaults to 0644.
+	Mode os.FileMode
+}
+
+func ZipFiles(filename string, files []File) error {
+	return ZipFilesWithOptions(filename, files, ZipOptions{})
+}
+
+func ZipFilesWithOptions(filename string, files []File, options ZipOptions) error {
+	names, err := writeZip(filename, files, options)
+	if err != nil {
+		return err
+	}
+
+	// Every file, extra file and directory above them should have become
+	// exactly one entry.
+	if planned := len(files) + len(options.ExtraFiles) + len(intermediateDirs(files, options.ExtraFiles)); len(names) != planned {
+		return fmt.Errorf("failed to write %s: wrote %d entries, expected %d", filename, len(names), planned)
+	}
+
+	if !options.SkipVerify {
+		if err := checkZipEntries(filename, names); err != nil {
+			return fmt.Errorf("failed to verify %s: %v", filename, err)
+		}
+	}
+	return nil
+}
+
+// writeZip writes files to filename and returns the names of the entries
+// written.
+func writeZip(filename string, files []File, options ZipOptions) ([]string, error) {
+	// Checked before the file is created, so no empty archive is left.
+	if err := checkEntryNames(files, options.ExtraFiles); err != nil {
+		return nil, err
+	}
+
+	newfile, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer newfile.Close()
+
+	names, err := writeZipTo(newfile, files, options)
+	if err != nil {
+		switch e := err.(type) {
+		case cancelledError:
+			err = e.error
+			os.Remove(filename)
+		case openError:
+			err = e.error
+			if removeErr := os.Remove(filename); removeErr != nil {
+				err = fmt.Errorf("%s. Failed to remove broken buildpack file: %s", err.Error(), filename)
+			}
+		}
+		return nil, err
+	}
+	return names, newfile.Close()
+}
+
+// openError reports an included file which could not be opened.
+type openError struct{ error }
+
+// cancelledError reports that ZipOptions.Context was done before the
+// archive was complete.
+type cancelledError struct{ error }
+
+// writeZipTo writes files as a zip archive to w and returns the names of
+// the entries written.
+func writeZipTo(w io.Writer, files []File, options ZipOptions) ([]string, error) {
+	if err := checkEntryNames(files, options.ExtraFiles); err != nil {
+		return nil, err
+	}
+
+	zipWriter := zip.NewWriter(w)
+	defer zipWriter.Close()
+	if options.Compressor != nil {
+		zipWriter.RegisterCompressor(zip.Deflate, options.Compressor)
+	}
+	if options.Comment != "" {
+		if err := zipWriter.SetComment(options.Comment); err != nil {
+			return nil, err
+		}
+	}
+
+	names := []string{}
+
+	type source struct {
+		file  File
+		extra *ExtraFile
+		dir   bool
+	}
+	sources := make([]source, 0, len(files)+len(options.ExtraFiles))
+	for _, file := range files {
+		sources = append(sources, source{file: file})
+	}
+	for i := range options.ExtraFiles {
+		extra := &options.ExtraFiles[i]
+		sources = append(sources, source{file: File{Name: extra.Name}, extra: extra})
+	}
+	// Directories get entries of their own, so that they are extracted with
+	// the modes they have in the source tree rather than whatever the unzip
+	// tool picks.
+	for _, dir := range intermediateDirs(files, options.ExtraFiles) {
+		sources = append(sources, source{file: dir, dir: true})
+	}
+
+	// Write entries in name order so the layout of the archive does not
+	// depend on the order files were gathered in.
+	sort.SliceStable(sources, func(i, j int) bool {
+		return zipEntryName(sources[i].file.Name) < zipEntryName(sources[j].file.Name)
+	})
+
+	// Add files to zip
+	for _, source := range sources {
+		if options.Context != nil && options.Context.Err() != nil {
+			return nil, cancelledError{options.Context.Err()}
+		}
+		file := source.file
+		if source.dir {
+			if err := writeDirEntry(zipWriter, file, options); err != nil {
+				return nil, err
+			}
+			names = append(names, zipEntryName(file.Name)+"/")
+			continue
+		}
+		if source.extra != nil {
+			if err := writeExtraFile(zipWriter, *source.extra, options); err != nil {
+				return nil, err
+			}
+			names = append(names, zipEntryName(file.Name))
+			if options.OnFile != nil {
+				options.OnFile(file)
+			}
+			continue
+		}
+
+		name, err := writeFileEntry(zipWriter, file, options)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+
+		if options.OnFile != nil {
+			options.OnFile(file)
+		}
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// writeFileEntry adds file, read from disk, to zipWriter and returns the
+// name of its entry.
+func writeFileEntry(zipWriter *zip.Writer, file File, options ZipOptions) (string, error) {
+	zipfile, err := os.Open(file.Path)
+	if err != nil {
+		return "", openError{fmt.Errorf("failed to open included_file: %s, %v", file.Path, err)}
+	}
+	// Closed before the next file is opened, so that a buildpack of many
+	// files does not run out of descriptors.
+	defer zipfile.Close()
+
+	// Get the file information
+	info, err := zipfile.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return "", err
+	}
+
+	// Change to deflate to gain better compression
+	// see http://golang.org/pkg/archive/zip/#pkg-constants
+	header.Method = zip.Deflate
+	if isCompressed(file.Name) {
+		// Deflating them again gains nothing and can even grow them
+		header.Method = zip.Store
+	}
+	header.Name = zipEntryName(file.Name)
+	if info.IsDir() {
+		// Directories are stored as empty entries whose name ends in a slash
+		header.Method = zip.Store
+		header.Name = strings.TrimSuffix(header.Name, "/") + "/"
+	}
+
+	// Record the unix mode explicitly, rather than relying on the
+	// defaults of FileInfoHeader, so that unzip tools keep the
+	// executable bit of scripts such as bin/compile and pre_package.
+	header.CreatorVersion = creatorUnix<<8 | header.CreatorVersion&0xff
+	header.ExternalAttrs = zipExternalAttrs(options.entryMode(info.Mode()))
+
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		if _, err = io.Copy(writer, zipfile); err != nil {
+			return "", err
+		}
+	}
+	return header.Name, nil
+}
+
+// compressedExtensions are the extensions of files stored in archives
+// as they are, since they are compressed already.
+var compressedExtensions = []string{
+	".7z", ".br", ".bz2", ".gz", ".jar", ".lz4", ".tbz", ".tbz2", ".tgz", ".txz", ".tzst", ".xz", ".zip", ".zst",
+}
+
+func isCompressed(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range compressedExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEntryNames rejects files and extra files which would be written to
+// the same entry, since only one of them would survive extraction.
+func checkEntryNames(files []File, extras []ExtraFile) error {
+	sources := map[string]string{}
+	var duplicates []string
+	add := func(name, source string) {
+		// Names which differ only in form, such as a.txt and ./a.txt, are
+		// still extracted to the same place.
+		name = path.Clean(zipEntryName(name))
+		if first, ok := sources[name]; ok {
+			duplicates = append(duplicates, fmt.Sprintf("%s (from %s and %s)", name, first, source))
+			return
+		}
+		sources[name] = source
+	}
+	for _, file := range files {
+		add(file.Name, file.Path)
+	}
+	for _, extra := range extras {
+		add(extra.Name, "extra file")
+	}
+
+	if len(duplicates) > 0 {
+		return fmt.Errorf("duplicate zip entries: %s", strings.Join(duplicates, ", "))
+	}
+	return nil
+}
+
+// intermediateDirs lists the directories above files and extra files which
+// are not themselves among them. Each has the Path of the same directory in
+// the tree the file came from, or no Path when that is not known, such as
+// for a dependency zipped from the cache.
+func intermediateDirs(files []File, extras []ExtraFile) []File {
+	present := map[string]bool{}
+	for _, file := range files {
+		present[path.Clean(zipEntryName(file.Name))] = true
+	}
+	for _, extra := range extras {
+		present[path.Clean(zipEntryName(extra.Name))] = true
+	}
+
+	var dirs []File
+	add := func(name, sourcePath string) {
+		name = path.Clean(zipEntryName(name))
+		// The root of the tree, when sourcePath ends with name.
+		root, known := "", false
+		if slashed := filepath.ToSlash(sourcePath); sourcePath != "" && strings.HasSuffix(slashed, "/"+name) {
+			root, known = strings.TrimSuffix(slashed, name), true
+		}
+		for dir := path.Dir(name); dir != "." && dir != "/" && !present[dir]; dir = path.Dir(dir) {
+			present[dir] = true
+			dirPath := ""
+			if known {
+				dirPath = filepath.FromSlash(root + dir)
+			}
+			dirs = append(dirs, File{Name: dir, Path: dirPath})
+		}
+	}
+	for _, file := range files {
+		add(file.Name, file.Path)
+	}
+	for _, extra := range extras {
+		add(extra.Name, "")
+	}
+	return dirs
+}
+
+// writeDirEntry writes the entry of a directory found by intermediateDirs,
+// with the mode and modification time of its Path, or 0755 and now when
+// that is not a directory.
+func writeDirEntry(zipWriter *zip.Writer, dir File, options ZipOptions) error {
+	mode, modified := os.ModeDir|0755, time.Now()
+	if dir.Path != "" {
+		if info, err := os.Stat(dir.Path); err == nil && info.IsDir() {
+			mode, modified = info.Mode(), info.ModTime()
+		}
+	}
+	header := &zip.FileHeader{
+		Name:     zipEntryName(dir.Name) + "/",
+		Method:   zip.Store,
+		Modified: modified,
+	}
+	header.CreatorVersion = creatorUnix<<8 | 20
+	header.ExternalAttrs = zipExternalAttrs(options.entryMode(mode))
+	_, err := zipWriter.CreateHeader(header)
+	return err
+}
+
+func writeExtraFile(zipWriter *zip.Writer, extra ExtraFile, options ZipOptions) error {
+	mode := extra.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+	header := &zip.FileHeader{
+		Name:     zipEntryName(extra.Name),
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	}
+	header.CreatorVersion = creatorUnix<<8 | 20
+	header.ExternalAttrs = zipExternalAttrs(options.entryMode(mode))
+
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(extra.Contents)
+	return err
+}
+
+const (
+	creatorUnix = 3
+
+	unixRegular = 0100000
+	unixDir     = 040000
+	msdosDir    = 0x10
+)
+
+// zipExternalAttrs encodes mode as the unix external attributes of a zip
+// entry, with the MS-DOS directory flag set for directories.
+func zipExternalAttrs(mode os.FileMode) uint32 {
+	attrs := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		attrs |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		attrs |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		attrs |= 01000
+	}
+	if mode.IsDir() {
+		return (attrs|unixDir)<<16 | msdosDir
+	}
+	return (attrs | unixRegular) << 16
+}
+
+// checkZipEntries checks that the archive holds exactly the entries in
+// names and that their contents can be read back.
+func checkZipEntries(filename string, names []string) error {
+	reader, err := zip.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	entries := map[string]*zip.File{}
+	for _, f := range reader.File {
+		entries[f.Name] = f
+	}
+
+	var missing []string
+	for _, name := range names {
+		f, ok := entries[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("could not open entry %s: %v", name, err)
+		}
+		_, err = io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("could not read entry %s: %v", name, err)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing entries: %s", strings.Join(missing, ", "))
+	}
+	if len(reader.File) != len(names) {
+		return fmt.Errorf("archive has %d entries, expected %d", len(reader.File), len(names))
+	}
+	return nil
+}
+
+// zipEntryName converts name to the forward-slash form required by the zip
+// format, whatever separator the host OS uses.
+func zipEntryName(name string) string {
+	return strings.Replace(filepath.ToSlash(name), `\`, "/", -1)
+}
+
+// ExtractZip extracts an archive such as one written by ZipFiles into
+// destDir, restoring file modes and symlinks. Entries, and symlink targets,
+// which would end up outside of destDir are rejected.
+func ExtractZip(zipPath, destDir string) error {
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	destDir, err = filepath.Abs(destDir)
+	if err != nil {
+		return err
+	}
+
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	var dirs []dirMode
+	// Symlinks already extracted. Their targets are only checked as text,
+	// so nothing may be extracted through them: a link to a directory
+	// inside destDir could otherwise be followed by a later link out of it.
+	symlinks := map[string]bool{}
+
+	for _, f := range reader.File {
+		path := filepath.Join(destDir, filepath.FromSlash(f.Name))
+		if !withinDir(destDir, path) {
+			return fmt.Errorf("zip entry %s would be extracted outside of %s", f.Name, destDir)
+		}
+		for p := path; p != destDir; p = filepath.Dir(p) {
+			if symlinks[p] {
+				return fmt.Errorf("zip entry %s would be extracted through the symlink %s", f.Name, p)
+			}
+		}
+
+		mode := f.Mode()
+		if mode.IsDir() {
+			// Directories stay writable until their contents are extracted
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMode{path, mode.Perm()})
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		if err := extractZipFile(f, path, destDir); err != nil {
+			return err
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			symlinks[path] = true
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractZipFile(f *zip.File, path, destDir string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if f.Mode()&os.ModeSymlink != 0 {
+		target, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		if !withinDir(destDir, resolveSymlinkTarget(path, string(target))) {
+			return fmt.Errorf("zip entry %s links to %s, which is outside of %s", f.Name, target, destDir)
+		}
+		return os.Symlink(string(target), path)
+	}
+
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, f.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fh, rc); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+type ZipEntry struct {
+	Name    string
+	Size    uint64
+	Mode    os.FileMode
+	Symlink bool
+}
+
+// ListZipContents describes every entry of the archive at zipPath, in
+// archive order. Size is the uncompressed size.
+func ListZipContents(zipPath string) ([]ZipEntry, error) {
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	entries := make([]ZipEntry, 0, len(reader.File))
+	for _, f := range reader.File {
+		entries = append(entries, ZipEntry{
+			Name:    f.Name,
+			Size:    f.UncompressedSize64,
+			Mode:    f.Mode(),
+			Symlink: f.Mode()&os.ModeSymlink != 0,
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,406 @@
+package packager_test
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/libbuildpack/packager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ZipFiles", func() {
+	var (
+		tmpDir  string
+		zipFile string
+		files   []packager.File
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "packager-zip")
+		Expect(err).NotTo(HaveOccurred())
+		zipFile = filepath.Join(tmpDir, "out.zip")
+
+		files = nil
+		for _, name := range []string{"a.txt", "b.txt"} {
+			path := filepath.Join(tmpDir, name)
+			Expect(ioutil.WriteFile(path, []byte("contents of "+name), 0644)).To(Succeed())
+			files = append(files, packager.File{Name: name, Path: path})
+		}
+	})
+
+	AfterEach(func() { os.RemoveAll(tmpDir) })
+
+	It("writes every file to the archive", func() {
+		Expect(packager.ZipFiles(zipFile, files)).To(Succeed())
+
+		Expect(ZipContents(zipFile, "a.txt")).To(Equal("contents of a.txt"))
+		Expect(ZipContents(zipFile, "b.txt")).To(Equal("contents of b.txt"))
+	})
+
+	It("gives the directories above a file entries with their modes", func() {
+		dir := filepath.Join(tmpDir, "lib", "foo")
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "bar.so"), []byte("bar"), 0644)).To(Succeed())
+		Expect(os.Chmod(dir, 0555)).To(Succeed())
+		defer os.Chmod(dir, 0755)
+
+		Expect(packager.ZipFiles(zipFile, []packager.File{{Name: "lib/foo/bar.so", Path: filepath.Join(dir, "bar.so")}})).To(Succeed())
+
+		reader, err := zip.OpenReader(zipFile)
+		Expect(err).NotTo(HaveOccurred())
+		defer reader.Close()
+		modes := map[string]os.FileMode{}
+		for _, f := range reader.File {
+			modes[f.Name] = f.Mode()
+		}
+		Expect(modes).To(Equal(map[string]os.FileMode{
+			"lib/":           os.ModeDir | 0755,
+			"lib/foo/":       os.ModeDir | 0555,
+			"lib/foo/bar.so": 0644,
+		}))
+	})
+
+	It("normalizes modes when asked to", func() {
+		dir := filepath.Join(tmpDir, "bin")
+		Expect(os.Mkdir(dir, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "run"), []byte("#!/bin/sh\n"), 0777)).To(Succeed())
+		Expect(os.Chmod(filepath.Join(dir, "run"), 0777)).To(Succeed())
+		Expect(os.Chmod(files[0].Path, 0666)).To(Succeed())
+		Expect(os.Chmod(files[1].Path, 0600)).To(Succeed())
+
+		files = append(files, packager.File{Name: "bin/run", Path: filepath.Join(dir, "run")})
+		Expect(packager.ZipFilesWithOptions(zipFile, files, packager.ZipOptions{
+			NormalizeModes: true,
+			ExtraFiles:     []packager.ExtraFile{{Name: "extra.sh", Contents: []byte("x"), Mode: 0775}},
+		})).To(Succeed())
+
+		reader, err := zip.OpenReader(zipFile)
+		Expect(err).NotTo(HaveOccurred())
+		defer reader.Close()
+		modes := map[string]os.FileMode{}
+		for _, f := range reader.File {
+			modes[f.Name] = f.Mode()
+		}
+		Expect(modes).To(Equal(map[string]os.FileMode{
+			"a.txt":    0644,
+			"b.txt":    0644,
+			"bin/":     os.ModeDir | 0755,
+			"bin/run":  0755,
+			"extra.sh": 0755,
+		}))
+	})
+
+	It("writes entries sorted by name", func() {
+		files = []packager.File{files[1], {Name: "VERSION", Path: files[0].Path}, files[0]}
+		Expect(packager.ZipFiles(zipFile, files)).To(Succeed())
+
+		entries, err := packager.ListZipContents(zipFile)
+		Expect(err).NotTo(HaveOccurred())
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		Expect(names).To(Equal([]string{"VERSION", "a.txt", "b.txt"}))
+	})
+
+	It("writes extra files from memory in name order", func() {
+		Expect(packager.ZipFilesWithOptions(zipFile, files, packager.ZipOptions{
+			ExtraFiles: []packager.ExtraFile{{Name: "BUILD_INFO.json", Contents: []byte(`{"sha":"abc"}`)}, {Name: "a.sh", Contents: []byte("echo"), Mode: 0755}},
+		})).To(Succeed())
+
+		entries, err := packager.ListZipContents(zipFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(Equal([]packager.ZipEntry{
+			{Name: "BUILD_INFO.json", Size: 13, Mode: 0644},
+			{Name: "a.sh", Size: 4, Mode: 0755},
+			{Name: "a.txt", Size: 17, Mode: 0644},
+			{Name: "b.txt", Size: 17, Mode: 0644},
+		}))
+		Expect(ZipContents(zipFile, "BUILD_INFO.json")).To(Equal(`{"sha":"abc"}`))
+	})
+
+	It("rejects files written to the same entry", func() {
+		files = append(files, packager.File{Name: "./a.txt", Path: files[1].Path})
+		err := packager.ZipFilesWithOptions(zipFile, files, packager.ZipOptions{
+			ExtraFiles: []packager.ExtraFile{{Name: "b.txt"}},
+		})
+		Expect(err).To(MatchError(ContainSubstring("duplicate zip entries: ")))
+		Expect(err).To(MatchError(ContainSubstring("a.txt (from " + files[0].Path + " and " + files[1].Path + ")")))
+		Expect(err).To(MatchError(ContainSubstring("b.txt (from " + files[1].Path + " and extra file)")))
+		Expect(zipFile).NotTo(BeAnExistingFile())
+	})
+
+	It("stores compressed files without deflating them again", func() {
+		data := make([]byte, 64*1024)
+		rand.New(rand.NewSource(1)).Read(data)
+		path := filepath.Join(tmpDir, "dep.tar.zst")
+		Expect(ioutil.WriteFile(path, data, 0644)).To(Succeed())
+		Expect(packager.ZipFiles(zipFile, append(files, packager.File{Name: "dependencies/dep.tar.zst", Path: path}))).To(Succeed())
+
+		reader, err := zip.OpenReader(zipFile)
+		Expect(err).NotTo(HaveOccurred())
+		defer reader.Close()
+
+		for _, f := range reader.File {
+			if f.Name == "dependencies/dep.tar.zst" {
+				Expect(f.Method).To(Equal(zip.Store))
+				Expect(f.CompressedSize64).To(Equal(uint64(len(data))))
+			} else if !f.Mode().IsDir() {
+				Expect(f.Method).To(Equal(zip.Deflate))
+			}
+		}
+		Expect(ZipContents(zipFile, "dependencies/dep.tar.zst")).To(Equal(string(data)))
+	})
+
+	It("closes each file once it is written", func() {
+		if _, err := os.Stat("/proc/self/fd"); err != nil {
+			Skip("open files cannot be counted")
+		}
+		for i := 0; i < 50; i++ {
+			path := filepath.Join(tmpDir, fmt.Sprintf("file-%d.txt", i))
+			Expect(ioutil.WriteFile(path, []byte("contents"), 0644)).To(Succeed())
+			files = append(files, packager.File{Name: filepath.Base(path), Path: path})
+		}
+
+		openFiles := func() int {
+			fds, err := ioutil.ReadDir("/proc/self/fd")
+			Expect(err).NotTo(HaveOccurred())
+			return len(fds)
+		}
+		before, most := openFiles(), 0
+		Expect(packager.ZipFilesWithOptions(zipFile, files, packager.ZipOptions{
+			OnFile: func(packager.File) {
+				if n := openFiles(); n > most {
+					most = n
+				}
+			},
+		})).To(Succeed())
+		Expect(most - before).To(BeNumerically("<", 5))
+	})
+
+	It("compresses with the registered compressor", func() {
+		calls := 0
+		compressor := func(w io.Writer) (io.WriteCloser, error) {
+			calls++
+			return flate.NewWriter(w, flate.BestSpeed)
+		}
+		Expect(packager.ZipFilesWithOptions(zipFile, files, packager.ZipOptions{Compressor: compressor})).To(Succeed())
+
+		Expect(calls).To(Equal(2))
+		Expect(ZipContents(zipFile, "a.txt")).To(Equal("contents of a.txt"))
+		Expect(ZipContents(zipFile, "b.txt")).To(Equal("contents of b.txt"))
+	})
+
+	It("sets the archive comment", func() {
+		Expect(packager.ZipFilesWithOptions(zipFile, files, packager.ZipOptions{Comment: "version: 1.2.3"})).To(Succeed())
+
+		reader, err := zip.OpenReader(zipFile)
+		Expect(err).NotTo(HaveOccurred())
+		defer reader.Close()
+		Expect(reader.Comment).To(Equal("version: 1.2.3"))
+	})
+
+	It("uses forward slashes in entry names", func() {
+		files[0].Name = filepath.Join("bin", "compile")
+		files[1].Name = `lib\helper.sh`
+		Expect(packager.ZipFiles(zipFile, files)).To(Succeed())
+
+		Expect(ZipContents(zipFile, "bin/compile")).To(Equal("contents of a.txt"))
+		Expect(ZipContents(zipFile, "lib/helper.sh")).To(Equal("contents of b.txt"))
+	})
+
+	It("records unix modes in the entry headers", func() {
+		Expect(os.Chmod(files[0].Path, 0755)).To(Succeed())
+		Expect(packager.ZipFiles(zipFile, files)).To(Succeed())
+
+		reader, err := zip.OpenReader(zipFile)
+		Expect(err).NotTo(HaveOccurred())
+		defer reader.Close()
+
+		Expect(reader.File[0].CreatorVersion >> 8).To(Equal(uint16(3)))
+		Expect(reader.File[0].ExternalAttrs >> 16).To(Equal(uint32(0100755)))
+		Expect(reader.File[1].ExternalAttrs >> 16).To(Equal(uint32(0100644)))
+	})
+
+	Context("the archive is damaged while it is written", func() {
+		var options packager.ZipOptions
+		BeforeEach(func() {
+			// Large enough that a.txt is flushed before the archive is damaged
+			data := make([]byte, 64*1024)
+			rand.New(rand.NewSource(1)).Read(data)
+			Expect(ioutil.WriteFile(files[0].Path, data, 0644)).To(Succeed())
+
+			options = packager.ZipOptions{
+				OnFile: func(file packager.File) {
+					if file.Name == "b.txt" {
+						Expect(os.Truncate(zipFile, 0)).To(Succeed())
+					}
+				},
+			}
+		})
+
+		It("fails verification", func() {
+			err := packager.ZipFilesWithOptions(zipFile, files, options)
+			Expect(err).To(MatchError(HavePrefix("failed to verify " + zipFile)))
+		})
+
+		It("skips verification when asked to", func() {
+			options.SkipVerify = true
+			Expect(packager.ZipFilesWithOptions(zipFile, files, options)).To(Succeed())
+		})
+	})
+
+	Describe("ExtractZip", func() {
+		var destDir string
+
+		BeforeEach(func() {
+			destDir = filepath.Join(tmpDir, "extracted")
+		})
+
+		type entry struct {
+			name, contents string
+			mode           os.FileMode
+		}
+
+		writeZip := func(entries ...entry) {
+			fh, err := os.Create(zipFile)
+			Expect(err).NotTo(HaveOccurred())
+			defer fh.Close()
+
+			w := zip.NewWriter(fh)
+			for _, e := range entries {
+				header := &zip.FileHeader{Name: e.name}
+				header.SetMode(e.mode)
+				entryWriter, err := w.CreateHeader(header)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = entryWriter.Write([]byte(e.contents))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(w.Close()).To(Succeed())
+		}
+
+		It("restores the files written by ZipFiles along with their modes", func() {
+			Expect(os.Chmod(files[0].Path, 0755)).To(Succeed())
+			files[0].Name = "bin/compile"
+			Expect(packager.ZipFiles(zipFile, files)).To(Succeed())
+
+			Expect(packager.ExtractZip(zipFile, destDir)).To(Succeed())
+
+			contents, err := ioutil.ReadFile(filepath.Join(destDir, "bin/compile"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("contents of a.txt"))
+
+			info, err := os.Stat(filepath.Join(destDir, "bin/compile"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+		})
+
+		It("restores symlinks and directory modes", func() {
+			writeZip(
+				entry{"lib/", "", os.ModeDir | 0555},
+				entry{"lib/real.so", "library", 0644},
+				entry{"lib/link.so", "real.so", os.ModeSymlink | 0777},
+			)
+			Expect(packager.ExtractZip(zipFile, destDir)).To(Succeed())
+			defer os.Chmod(filepath.Join(destDir, "lib"), 0755)
+
+			Expect(os.Readlink(filepath.Join(destDir, "lib/link.so"))).To(Equal("real.so"))
+			info, err := os.Stat(filepath.Join(destDir, "lib"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0555)))
+		})
+
+		It("refuses entries that escape the destination", func() {
+			writeZip(entry{"../evil.sh", "#!/bin/sh", 0755})
+
+			err := packager.ExtractZip(zipFile, destDir)
+			Expect(err).To(MatchError(ContainSubstring("zip entry ../evil.sh would be extracted outside of")))
+			Expect(filepath.Join(tmpDir, "evil.sh")).NotTo(BeAnExistingFile())
+		})
+
+		It("refuses symlinks that escape the destination", func() {
+			writeZip(entry{"passwd", "../../etc/passwd", os.ModeSymlink | 0777})
+
+			err := packager.ExtractZip(zipFile, destDir)
+			Expect(err).To(MatchError(ContainSubstring("zip entry passwd links to ../../etc/passwd, which is outside of")))
+		})
+
+		It("refuses entries extracted through an earlier symlink", func() {
+			writeZip(
+				entry{"x/b", "..", os.ModeSymlink | 0777},
+				entry{"x/b/c", "../..", os.ModeSymlink | 0777},
+				entry{"c/pwned", "pwned", 0644},
+			)
+
+			err := packager.ExtractZip(zipFile, destDir)
+			Expect(err).To(MatchError(ContainSubstring("zip entry x/b/c would be extracted through the symlink " + filepath.Join(destDir, "x/b"))))
+			Expect(filepath.Join(tmpDir, "pwned")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(filepath.Dir(tmpDir), "pwned")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Describe("ListZipContents", func() {
+		It("describes each entry", func() {
+			Expect(os.Chmod(files[0].Path, 0755)).To(Succeed())
+			Expect(packager.ZipFiles(zipFile, files)).To(Succeed())
+
+			Expect(packager.ListZipContents(zipFile)).To(Equal([]packager.ZipEntry{
+				{Name: "a.txt", Size: 17, Mode: 0755},
+				{Name: "b.txt", Size: 17, Mode: 0644},
+			}))
+		})
+
+		It("returns an error for a missing archive", func() {
+			_, err := packager.ListZipContents(filepath.Join(tmpDir, "missing.zip"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+func BenchmarkZipFiles(b *testing.B) {
+	tmpDir, err := ioutil.TempDir("", "packager-zip-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var files []packager.File
+	random := rand.New(rand.NewSource(1))
+	for _, name := range []string{"a.bin", "b.bin", "c.bin", "d.bin"} {
+		data := make([]byte, 1024*1024)
+		random.Read(data[:len(data)/2])
+		path := filepath.Join(tmpDir, name)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			b.Fatal(err)
+		}
+		files = append(files, packager.File{Name: name, Path: path})
+	}
+
+	for _, bench := range []struct {
+		name       string
+		compressor zip.Compressor
+	}{
+		{"default", nil},
+		{"registered", func(w io.Writer) (io.WriteCloser, error) { return flate.NewWriter(w, flate.BestSpeed) }},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			zipFile := filepath.Join(tmpDir, bench.name+".zip")
+			options := packager.ZipOptions{Compressor: bench.compressor, SkipVerify: true}
+			for i := 0; i < b.N; i++ {
+				if err := packager.ZipFilesWithOptions(zipFile, files, options); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}